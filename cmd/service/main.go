@@ -1,9 +1,15 @@
 package main
 
 import (
+	"os"
+
 	"github.com/fionn/address-manager/service"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		service.RunMigrate(os.Args[2:])
+		return
+	}
 	service.Run()
 }
@@ -1,19 +1,29 @@
 package fb_mock
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	mrand "math/rand"
 	"net/http"
+	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil/base58"
 	"github.com/btcsuite/btcutil/bech32"
 
@@ -26,10 +36,43 @@ import (
 
 var ErrAssetUnknown = errors.New("unknown asset type")
 
-// Fireblocks error response.
-type FBError struct {
-	APIErrorCode int    `json:"error_code,omitempty"`
-	Message      string `json:"message"`
+// Mock configuration.
+type Config struct {
+	// If set, requests must carry a JWT signed by the matching private key,
+	// see https://developers.fireblocks.com/reference/signing-a-request-jwt-structure.
+	PublicKey *rsa.PublicKey
+	// If set, requests must carry this in X-API-Key and their JWT's subject.
+	APIKey string
+	// If set, requests beyond this many per second (in bursts of up to
+	// RateLimitBurst) get a 429 with a Retry-After header.
+	RateLimit      float64
+	RateLimitBurst int
+	// The assets vault accounts can hold, by asset ID. DefaultAssets if
+	// nil.
+	Assets map[string]Asset
+	// How long creating anything takes, e.g. so clients time out. The work
+	// is done regardless, like it would be if we'd lost the response.
+	Latency time.Duration
+}
+
+// How the mock makes up addresses for an asset.
+type Asset struct {
+	// bech32, base58 or hex.
+	Format string
+	// Whether addresses come with a tag, e.g. an XRP destination tag.
+	Tag bool
+}
+
+// The assets the mock knows about unless configured otherwise.
+var DefaultAssets = map[string]Asset{
+	"BTC":       {Format: "bech32"},
+	"BTC_TEST":  {Format: "bech32"},
+	"SOL":       {Format: "base58"},
+	"SOL_TEST":  {Format: "base58"},
+	"ETH":       {Format: "hex"},
+	"ETH_TEST5": {Format: "hex"},
+	"XRP":       {Format: "base58", Tag: true},
+	"XRP_TEST":  {Format: "base58", Tag: true},
 }
 
 // Generate a slice of cryptographically secure random bytes of length size.
@@ -66,21 +109,47 @@ func generateSOLAddress() (string, error) {
 	return base58.Encode(fakePubKey), nil
 }
 
-// Given an asset ID (e.g. "BTC"), return a random address for it.
-func generateAddressForAsset(assetId string) (string, error) {
-	switch assetId {
-	case "BTC":
-		return generateBTCAddress()
-	case "SOL":
-		return generateSOLAddress()
+// Generate a random Ethereum-style address (20 bytes, hex encoded).
+func generateHexAddress() string {
+	return "0x" + hex.EncodeToString(randomBytes(20))
+}
+
+// Generate a random legacy (P2PKH) Bitcoin address, which Fireblocks returns
+// alongside SegWit ones.
+func generateLegacyBTCAddress() (string, error) {
+	address, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(randomBytes(33)), &chaincfg.TestNet3Params)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode legacy address: %s", err)
+	}
+	return address.EncodeAddress(), nil
+}
+
+// Return a random address for an asset, with a legacy address and tag if it
+// has them.
+func generateAddress(asset Asset) (fb.Address, error) {
+	var address fb.Address
+	var err error
+	switch asset.Format {
+	case "bech32":
+		if address.Address, err = generateBTCAddress(); err == nil {
+			address.LegacyAddress, err = generateLegacyBTCAddress()
+		}
+	case "base58":
+		address.Address, err = generateSOLAddress()
+	case "hex":
+		address.Address = generateHexAddress()
 	default:
-		return "", ErrAssetUnknown
+		err = fmt.Errorf("unknown address format %q", asset.Format)
+	}
+	if asset.Tag {
+		address.Tag = strconv.FormatUint(uint64(binary.BigEndian.Uint32(randomBytes(4))), 10)
 	}
+	return address, err
 }
 
 // Helper to write error messages as HTTP responses.
 func writeError(w http.ResponseWriter, httpErrorCode int, message string, apiErrorCode int) {
-	fbError, err := json.MarshalIndent(FBError{apiErrorCode, message}, "", "  ")
+	fbError, err := json.MarshalIndent(fb.Error{Code: apiErrorCode, Message: message}, "", "  ")
 	if err != nil {
 		err = fmt.Errorf("failed to marshal error (%d: %s): %s", apiErrorCode, message, err)
 		log.Print(err)
@@ -94,11 +163,47 @@ func writeError(w http.ResponseWriter, httpErrorCode int, message string, apiErr
 	}
 }
 
+// Helper to write values as JSON HTTP responses.
+func writeResponse(w http.ResponseWriter, v any) {
+	response, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, err.Error(), 0)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(utils.BinaryNewline(response))
+	if err != nil {
+		log.Printf("Error writing response: %s", err)
+	}
+}
+
+// Helper to map store errors to Fireblocks error responses.
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrAssetUnknown):
+		// See https://developers.fireblocks.com/reference/api-responses#api-error-codes.
+		writeError(w, http.StatusNotFound, "Asset doesn't exist", 1006)
+	case errors.Is(err, ErrVaultAccountUnknown):
+		// See https://developers.fireblocks.com/reference/api-responses#api-error-codes.
+		writeError(w, http.StatusNotFound, "The Provided Vault Account ID is invalid", 11001)
+	case errors.Is(err, ErrAssetExists):
+		// I made this error up, it's not documented what fb would return,
+		// but it's a client error, so not worth retrying.
+		writeError(w, http.StatusBadRequest, "Vault account already has this asset", 0)
+	case errors.Is(err, ErrInvalidCursor):
+		// I made this error up, it's not documented what fb would return.
+		writeError(w, http.StatusBadRequest, "Invalid paging cursor", 0)
+	default:
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, err.Error(), 0)
+	}
+}
+
 // Handler to create a new vault. See
 // https://developers.fireblocks.com/reference/createvaultaccount.
-func handlePostCreateVaultAccount(w http.ResponseWriter, r *http.Request) {
-	// TODO: support Idempotency-Key.
-
+func (s *store) handlePostCreateVaultAccount(w http.ResponseWriter, r *http.Request) {
 	// The documentation on this endpoint is unclear, but the example request
 	// only sends two fields, both of which are explicitly optional, so we infer
 	// that all fields are optional which, for our purposes, means we can ignore
@@ -106,62 +211,66 @@ func handlePostCreateVaultAccount(w http.ResponseWriter, r *http.Request) {
 	//
 	// TODO: support optional fields.
 
-	// This isn't documented, but from the example response it seems to default
-	// to creating a single ETH wallet.
-	asset := fb.VaultAsset{ID: "ETH"}
-	fbVaultAccount := fb.VaultAccount{ID: strconv.Itoa(mrand.Int()), Assets: []fb.VaultAsset{asset}}
+	writeResponse(w, s.createVaultAccount())
+}
 
-	response, err := json.MarshalIndent(fbVaultAccount, "", "  ")
+// Parse the paging parameters of a list endpoint.
+func parsePaging(r *http.Request) (before, after string, limit int, err error) {
+	query := r.URL.Query()
+	limit = 200
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 500 {
+			return "", "", 0, errors.New("limit must be between 1 and 500")
+		}
+	}
+	return query.Get("before"), query.Get("after"), limit, nil
+}
+
+// Handler to list vault accounts, a page at a time. See
+// https://developers.fireblocks.com/reference/getpagedvaultaccounts.
+func (s *store) handleGetVaultAccountsPaged(w http.ResponseWriter, r *http.Request) {
+	before, after, limit, err := parsePaging(r)
 	if err != nil {
-		log.Print(err)
-		writeError(w, http.StatusInternalServerError, err.Error(), 0)
+		// I made this error up, it's not documented what fb would return.
+		writeError(w, http.StatusBadRequest, err.Error(), 0)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(utils.BinaryNewline(response))
+	accounts, paging, err := s.vaultAccountsPage(before, after, limit)
 	if err != nil {
-		log.Printf("Error writing response: %s", err)
+		writeStoreError(w, err)
+		return
 	}
+
+	writeResponse(w, fb.VaultAccountsPaged{Accounts: accounts, Paging: paging})
 }
 
-// Handler for the addresses_paginate endpoint.
+// Handler for the addresses_paginated endpoint, a page at a time.
 // See https://developers.fireblocks.com/reference/getvaultaccountassetaddressespaginated.
-func handleGetAddresses(w http.ResponseWriter, r *http.Request) {
-	assetId := chi.URLParam(r, "assetId")
-
-	address, err := generateAddressForAsset(assetId)
+func (s *store) handleGetAddresses(w http.ResponseWriter, r *http.Request) {
+	before, after, limit, err := parsePaging(r)
 	if err != nil {
-		if errors.Is(err, ErrAssetUnknown) {
-			// See https://developers.fireblocks.com/reference/api-responses#api-error-codes.
-			writeError(w, http.StatusNotFound, "Asset doesn't exist", 1006)
-			return
-		}
-		log.Print(err)
-		writeError(w, http.StatusInternalServerError, err.Error(), 0)
+		// I made this error up, it's not documented what fb would return.
+		writeError(w, http.StatusBadRequest, err.Error(), 0)
 		return
 	}
 
-	fbAddress := fb.Address{AssetId: assetId, Address: address}
-	addresses, err := json.MarshalIndent(fb.Addresses{Addresses: []fb.Address{fbAddress}}, "", "  ")
+	vaultAccountId := chi.URLParam(r, "vaultAccountId")
+	assetId := chi.URLParam(r, "assetId")
+
+	addresses, paging, err := s.addressesPage(vaultAccountId, assetId, before, after, limit)
 	if err != nil {
-		log.Print(err)
-		writeError(w, http.StatusInternalServerError, err.Error(), 0)
+		writeStoreError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(utils.BinaryNewline(addresses))
-	if err != nil {
-		log.Printf("Error writing response: %s", err)
-	}
+	writeResponse(w, fb.Addresses{Addresses: addresses, Paging: paging})
 }
 
 // Handler to create a new vault wallet.
 // See https://developers.fireblocks.com/reference/createvaultaccountasset.
-func handlePostCreateVaultAccountAsset(w http.ResponseWriter, r *http.Request) {
-	// TODO: support Idempotency-Key.
-
+func (s *store) handlePostCreateVaultAccountAsset(w http.ResponseWriter, r *http.Request) {
 	vaultAccountId := chi.URLParam(r, "vaultAccountId")
 	assetId := chi.URLParam(r, "assetId")
 
@@ -171,50 +280,189 @@ func handlePostCreateVaultAccountAsset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	address, err := generateAddressForAsset(assetId)
+	fbVaultWallet, err := s.createVaultAccountAsset(vaultAccountId, assetId)
 	if err != nil {
-		if errors.Is(err, ErrAssetUnknown) {
-			// See https://developers.fireblocks.com/reference/api-responses#api-error-codes.
-			writeError(w, http.StatusNotFound, "Asset doesn't exist", 1006)
-			return
-		}
-		log.Print(err)
-		writeError(w, http.StatusInternalServerError, err.Error(), 0)
+		writeStoreError(w, err)
 		return
 	}
 
-	// Seems we can get away with this as we don't need to keep track of wallet
-	// IDs.
-	id := strconv.Itoa(mrand.Int())
+	writeResponse(w, fbVaultWallet)
+}
 
-	fbVaultWallet := fb.VaultWallet{ID: id, Address: address}
-	response, err := json.MarshalIndent(fbVaultWallet, "", "  ")
+// Handler to get a vault account.
+// See https://developers.fireblocks.com/reference/getvaultaccount.
+func (s *store) handleGetVaultAccount(w http.ResponseWriter, r *http.Request) {
+	account, err := s.vaultAccount(chi.URLParam(r, "vaultAccountId"))
 	if err != nil {
-		log.Print(err)
-		writeError(w, http.StatusInternalServerError, err.Error(), 0)
+		writeStoreError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(utils.BinaryNewline(response))
+	writeResponse(w, account)
+}
+
+// Handler to get a vault account's asset and its balance.
+// See https://developers.fireblocks.com/reference/getvaultaccountasset.
+func (s *store) handleGetVaultAccountAsset(w http.ResponseWriter, r *http.Request) {
+	asset, err := s.vaultAsset(chi.URLParam(r, "vaultAccountId"), chi.URLParam(r, "assetId"))
 	if err != nil {
-		log.Printf("Error writing response: %s", err)
+		writeStoreError(w, err)
+		return
+	}
+
+	writeResponse(w, asset)
+}
+
+// Handler to add a deposit address to a vault account's asset.
+// See https://developers.fireblocks.com/reference/createvaultaccountassetaddress.
+func (s *store) handlePostCreateAddress(w http.ResponseWriter, r *http.Request) {
+	// All fields are optional, so an empty body is fine.
+	var request fb.CreateAddressRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		// I made this error up, it's not documented what fb would return.
+		writeError(w, http.StatusBadRequest, "invalid request body", 0)
+		return
+	}
+
+	address, err := s.createAddress(chi.URLParam(r, "vaultAccountId"), chi.URLParam(r, "assetId"),
+		request.Description, request.CustomerRefId)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeResponse(w, fb.CreatedAddress{
+		Address:           address.Address,
+		LegacyAddress:     address.LegacyAddress,
+		EnterpriseAddress: address.EnterpriseAddress,
+		Tag:               address.Tag,
+		Bip44AddressIndex: address.Bip44AddressIndex,
+	})
+}
+
+// Handler to hide a vault account.
+// See https://developers.fireblocks.com/reference/hidevaultaccount.
+func (s *store) handlePostHideVaultAccount(w http.ResponseWriter, r *http.Request) {
+	if err := s.hideVaultAccount(chi.URLParam(r, "vaultAccountId")); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeResponse(w, map[string]bool{"success": true})
+}
+
+// Middleware to authenticate requests like Fireblocks does.
+func authenticate(config Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// These error codes are made up, Fireblocks doesn't document
+			// them.
+			apiKey := r.Header.Get("X-API-Key")
+			if config.APIKey != "" && apiKey != config.APIKey {
+				writeError(w, http.StatusUnauthorized, "Unauthorized: invalid API key", -7)
+				return
+			}
+
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				writeError(w, http.StatusUnauthorized, "Unauthorized: JWT is missing", -7)
+				return
+			}
+			claims, err := fb.VerifyToken(token, config.PublicKey)
+			if err != nil {
+				writeError(w, http.StatusUnauthorized, "Unauthorized: "+err.Error(), -7)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error(), 0)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			switch {
+			case claims.URI != r.URL.RequestURI():
+				writeError(w, http.StatusUnauthorized, "Unauthorized: JWT uri doesn't match request", -7)
+			case claims.BodyHash != fb.BodyHash(body):
+				writeError(w, http.StatusUnauthorized, "Unauthorized: JWT bodyHash doesn't match request", -7)
+			case claims.Subject != apiKey:
+				writeError(w, http.StatusUnauthorized, "Unauthorized: JWT sub doesn't match API key", -7)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// Middleware to reject requests beyond the rate limit.
+func rateLimit(limiter *fb.TokenBucket) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, wait := limiter.Allow(); !ok {
+				w.Header().Set("Retry-After", fb.FormatRetryAfter(wait))
+				// I made this error up, it's not documented what fb would
+				// return.
+				writeError(w, http.StatusTooManyRequests, "Too many requests", 0)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Middleware to take at least d over each request.
+func latency(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(d)
+			next.ServeHTTP(w, r)
+		})
 	}
 }
 
-func service() http.Handler {
+func service(config Config) http.Handler {
+	assets := config.Assets
+	if assets == nil {
+		assets = DefaultAssets
+	}
+	s := newStore(assets)
+	keys := newIdempotencyKeys()
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Get("/v1/vault/accounts/{vaultAccountId}/{assetId}/addresses_paginate", handleGetAddresses)
-	r.Post("/v1/vault/accounts/{vaultAccountId}/{assetId}", handlePostCreateVaultAccountAsset)
-	r.Post("/v1/vault/accounts", handlePostCreateVaultAccount)
+	if config.RateLimit > 0 {
+		r.Use(rateLimit(fb.NewTokenBucket(config.RateLimit, max(1, config.RateLimitBurst))))
+	}
+	if config.PublicKey != nil {
+		r.Use(authenticate(config))
+	}
+	r.Get("/v1/vault/accounts_paged", s.handleGetVaultAccountsPaged)
+	r.Get("/v1/vault/accounts/{vaultAccountId}", s.handleGetVaultAccount)
+	r.Get("/v1/vault/accounts/{vaultAccountId}/{assetId}", s.handleGetVaultAccountAsset)
+	r.Get("/v1/vault/accounts/{vaultAccountId}/{assetId}/addresses_paginated", s.handleGetAddresses)
+	r.Group(func(r chi.Router) {
+		r.Use(keys.middleware)
+		if config.Latency > 0 {
+			r.Use(latency(config.Latency))
+		}
+		r.Post("/v1/vault/accounts/{vaultAccountId}/hide", s.handlePostHideVaultAccount)
+		r.Post("/v1/vault/accounts/{vaultAccountId}/{assetId}", s.handlePostCreateVaultAccountAsset)
+		r.Post("/v1/vault/accounts/{vaultAccountId}/{assetId}/addresses", s.handlePostCreateAddress)
+		r.Post("/v1/vault/accounts", s.handlePostCreateVaultAccount)
+	})
 	return r
 }
 
 // Spin up the server and serve until context receives cancellation.
 func RunWithCancellation(ctx context.Context, wg *sync.WaitGroup, address string) {
-	server := &http.Server{Addr: address, Handler: service()}
+	RunWithConfig(ctx, wg, address, Config{})
+}
+
+// Spin up the server with the given configuration and serve until context
+// receives cancellation.
+func RunWithConfig(ctx context.Context, wg *sync.WaitGroup, address string, config Config) {
+	server := &http.Server{Addr: address, Handler: service(config)}
 
 	go func() {
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -226,9 +474,18 @@ func RunWithCancellation(ctx context.Context, wg *sync.WaitGroup, address string
 		select {
 		case <-ctx.Done():
 			log.Print("Cancelling mock server")
-			if err := server.Shutdown(ctx); err != nil {
+			// Don't shut down with ctx, which is already cancelled, otherwise
+			// Shutdown gives up before closing idle connections and clients
+			// can keep talking to this server (and its state) after we
+			// return.
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			if err := server.Shutdown(shutdownCtx); err != nil {
 				log.Print(err)
+				if err := server.Close(); err != nil {
+					log.Print(err)
+				}
 			}
+			cancel()
 			wg.Done()
 			return
 		default:
@@ -237,9 +494,95 @@ func RunWithCancellation(ctx context.Context, wg *sync.WaitGroup, address string
 	}
 }
 
+// Parse a comma-separated list of assets, each written ID=format, or
+// ID=format:tag if its addresses need a tag, e.g. "BTC=bech32,XRP=base58:tag".
+func parseAssets(list string) (map[string]Asset, error) {
+	assets := make(map[string]Asset)
+	for _, entry := range strings.Split(list, ",") {
+		assetId, spec, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || assetId == "" {
+			return nil, fmt.Errorf("expected ID=format, got %q", entry)
+		}
+		format, tag, _ := strings.Cut(spec, ":")
+		if !slices.Contains([]string{"bech32", "base58", "hex"}, format) {
+			return nil, fmt.Errorf("unknown address format %q for %s", format, assetId)
+		}
+		if tag != "" && tag != "tag" {
+			return nil, fmt.Errorf("expected %s=%s:tag, got %q", assetId, format, entry)
+		}
+		assets[assetId] = Asset{Format: format, Tag: tag == "tag"}
+	}
+	return assets, nil
+}
+
+// Load the mock's configuration from the environment. If
+// FB_MOCK_PUBLIC_KEY names a PEM file, requests must be authenticated against
+// it (and FB_MOCK_API_KEY, if that's set too). FB_MOCK_RATE_LIMIT and
+// FB_MOCK_RATE_LIMIT_BURST set the rate limit, FB_MOCK_ASSETS the assets and
+// FB_MOCK_LATENCY the latency.
+func configFromEnv() (Config, error) {
+	config := Config{APIKey: os.Getenv("FB_MOCK_API_KEY")}
+
+	if assets := os.Getenv("FB_MOCK_ASSETS"); assets != "" {
+		var err error
+		if config.Assets, err = parseAssets(assets); err != nil {
+			return config, fmt.Errorf("invalid FB_MOCK_ASSETS: %w", err)
+		}
+	}
+
+	if rateLimit := os.Getenv("FB_MOCK_RATE_LIMIT"); rateLimit != "" {
+		var err error
+		if config.RateLimit, err = strconv.ParseFloat(rateLimit, 64); err != nil {
+			return config, fmt.Errorf("invalid FB_MOCK_RATE_LIMIT: %w", err)
+		}
+	}
+	if burst := os.Getenv("FB_MOCK_RATE_LIMIT_BURST"); burst != "" {
+		var err error
+		if config.RateLimitBurst, err = strconv.Atoi(burst); err != nil {
+			return config, fmt.Errorf("invalid FB_MOCK_RATE_LIMIT_BURST: %w", err)
+		}
+	}
+
+	if latency := os.Getenv("FB_MOCK_LATENCY"); latency != "" {
+		var err error
+		if config.Latency, err = time.ParseDuration(latency); err != nil {
+			return config, fmt.Errorf("invalid FB_MOCK_LATENCY: %w", err)
+		}
+	}
+
+	publicKeyFile := os.Getenv("FB_MOCK_PUBLIC_KEY")
+	if publicKeyFile == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return config, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return config, fmt.Errorf("no PEM data in %s", publicKeyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return config, err
+	}
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return config, fmt.Errorf("%s is not an RSA public key", publicKeyFile)
+	}
+	config.PublicKey = publicKey
+	return config, nil
+}
+
 // Spin up the server and serve forever.
 func Run() {
-	r := service()
+	config, err := configFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %s", err)
+	}
+
+	r := service(config)
 	address := "localhost:6200"
 	log.Printf("listening on http://%s/", address)
 	if err := http.ListenAndServe(address, r); err != nil && err != http.ErrServerClosed {
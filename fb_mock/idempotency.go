@@ -0,0 +1,107 @@
+package fb_mock
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+
+	fb "github.com/fionn/address-manager/service/fireblocks"
+)
+
+// A response recorded for an idempotency key, along with what the request
+// looked like, so a retry can be told apart from reuse of the key.
+type idempotentResponse struct {
+	fingerprint string
+	// Zero while the original request is still being handled.
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Responses by idempotency key. Like the store, this lives as long as the
+// server does.
+type idempotencyKeys struct {
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+}
+
+func newIdempotencyKeys() *idempotencyKeys {
+	return &idempotencyKeys{responses: make(map[string]*idempotentResponse)}
+}
+
+// Captures a response as it's written, so it can be replayed.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Middleware to honour the Idempotency-Key header. The first successful
+// response for a key is replayed for any repeat of the request; a failed one
+// isn't kept, so the request can be retried.
+func (k *idempotencyKeys) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error(), 0)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := r.Method + " " + r.URL.Path + " " + fb.BodyHash(body)
+
+		// These errors are made up, Fireblocks doesn't document them.
+		k.mu.Lock()
+		if response, ok := k.responses[key]; ok {
+			k.mu.Unlock()
+			switch {
+			case response.fingerprint != fingerprint:
+				writeError(w, http.StatusBadRequest, "Idempotency-Key was already used for a different request", 0)
+			case response.status == 0:
+				writeError(w, http.StatusConflict, "A request with this Idempotency-Key is in progress", 0)
+			default:
+				for name, values := range response.header {
+					w.Header()[name] = values
+				}
+				w.WriteHeader(response.status)
+				w.Write(response.body)
+			}
+			return
+		}
+		response := &idempotentResponse{fingerprint: fingerprint}
+		k.responses[key] = response
+		k.mu.Unlock()
+
+		rec := &recorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if rec.status < 200 || rec.status >= 300 {
+			delete(k.responses, key)
+			return
+		}
+		response.status = rec.status
+		response.header = w.Header().Clone()
+		response.body = rec.body.Bytes()
+	})
+}
@@ -0,0 +1,71 @@
+package fb_mock
+
+import (
+	"encoding/base64"
+	"errors"
+	"slices"
+
+	fb "github.com/fionn/address-manager/service/fireblocks"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursors are opaque to clients, so they can't be mistaken for IDs.
+func encodeCursor(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	id, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	return string(id), nil
+}
+
+// Get up to limit items from either just before the item the before cursor
+// points at, or just after the one the after cursor points at, or from the
+// start if there's neither. Items are identified by id. The returned cursors
+// point at the ends of the page, and are empty if there's nothing beyond
+// them.
+func paginate[T any](items []T, before, after string, limit int, id func(T) string) ([]T, fb.Paging, error) {
+	index := func(cursor string) (int, error) {
+		cursorID, err := decodeCursor(cursor)
+		if err != nil {
+			return 0, err
+		}
+		i := slices.IndexFunc(items, func(item T) bool { return id(item) == cursorID })
+		if i < 0 {
+			return 0, ErrInvalidCursor
+		}
+		return i, nil
+	}
+
+	start, end := 0, min(limit, len(items))
+	switch {
+	case before != "" && after != "":
+		return nil, fb.Paging{}, ErrInvalidCursor
+	case after != "":
+		i, err := index(after)
+		if err != nil {
+			return nil, fb.Paging{}, err
+		}
+		start, end = i+1, min(i+1+limit, len(items))
+	case before != "":
+		i, err := index(before)
+		if err != nil {
+			return nil, fb.Paging{}, err
+		}
+		start, end = max(0, i-limit), i
+	}
+
+	page := items[start:end]
+	var paging fb.Paging
+	if start > 0 && len(page) > 0 {
+		paging.Before = encodeCursor(id(page[0]))
+	}
+	if end < len(items) && len(page) > 0 {
+		paging.After = encodeCursor(id(page[len(page)-1]))
+	}
+	return page, paging, nil
+}
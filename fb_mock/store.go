@@ -0,0 +1,208 @@
+package fb_mock
+
+import (
+	"errors"
+	mrand "math/rand"
+	"slices"
+	"strconv"
+	"sync"
+
+	fb "github.com/fionn/address-manager/service/fireblocks"
+)
+
+var ErrVaultAccountUnknown = errors.New("unknown vault account")
+
+var ErrAssetExists = errors.New("vault account already has asset")
+
+// A vault wallet and the addresses it holds.
+type vaultWallet struct {
+	wallet    fb.VaultWallet
+	addresses []fb.Address
+}
+
+type vaultAccount struct {
+	account fb.VaultAccount
+	wallets map[string]*vaultWallet
+}
+
+// In-memory state of the mock, so what we create can be read back. This
+// lives as long as the server does.
+type store struct {
+	mu sync.Mutex
+	// In creation order, which is what we page through.
+	accounts []*vaultAccount
+	byID     map[string]*vaultAccount
+	assets   map[string]Asset
+}
+
+func newStore(assets map[string]Asset) *store {
+	return &store{byID: make(map[string]*vaultAccount), assets: assets}
+}
+
+// Make up an address for an asset, if we know it.
+func (s *store) generateAddress(assetId string) (fb.Address, error) {
+	asset, ok := s.assets[assetId]
+	if !ok {
+		return fb.Address{}, ErrAssetUnknown
+	}
+	address, err := generateAddress(asset)
+	address.AssetId = assetId
+	return address, err
+}
+
+func (s *store) createVaultAccount() fb.VaultAccount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The example response lists an ETH asset, but that's only an example:
+	// a new vault account has no wallets until they're created, and listing
+	// one we can't back with addresses would stop it being created.
+	account := &vaultAccount{
+		account: fb.VaultAccount{ID: strconv.Itoa(mrand.Int()), Assets: []fb.VaultAsset{}},
+		wallets: make(map[string]*vaultWallet),
+	}
+	s.accounts = append(s.accounts, account)
+	s.byID[account.account.ID] = account
+	return account.account
+}
+
+func (s *store) createVaultAccountAsset(vaultAccountId, assetId string) (*fb.VaultWallet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.byID[vaultAccountId]
+	if !ok {
+		return nil, ErrVaultAccountUnknown
+	}
+	if slices.ContainsFunc(account.account.Assets, func(asset fb.VaultAsset) bool { return asset.ID == assetId }) {
+		return nil, ErrAssetExists
+	}
+
+	address, err := s.generateAddress(assetId)
+	if err != nil {
+		return nil, err
+	}
+
+	wallet := &vaultWallet{
+		wallet: fb.VaultWallet{
+			ID:            strconv.Itoa(mrand.Int()),
+			Address:       address.Address,
+			LegacyAddress: address.LegacyAddress,
+			Tag:           address.Tag,
+		},
+		addresses: []fb.Address{address},
+	}
+	account.wallets[assetId] = wallet
+	account.account.Assets = append(account.account.Assets, newVaultAsset(assetId))
+	return &wallet.wallet, nil
+}
+
+// A new, and so empty, vault asset.
+func newVaultAsset(assetId string) fb.VaultAsset {
+	return fb.VaultAsset{ID: assetId, Total: "0", Available: "0", Pending: "0", Frozen: "0", LockedAmmount: "0"}
+}
+
+func (s *store) vaultAccount(vaultAccountId string) (*fb.VaultAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.byID[vaultAccountId]
+	if !ok {
+		return nil, ErrVaultAccountUnknown
+	}
+	vaultAccount := account.account
+	vaultAccount.Assets = append([]fb.VaultAsset(nil), account.account.Assets...)
+	return &vaultAccount, nil
+}
+
+func (s *store) vaultAsset(vaultAccountId, assetId string) (*fb.VaultAsset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.byID[vaultAccountId]
+	if !ok {
+		return nil, ErrVaultAccountUnknown
+	}
+	for _, asset := range account.account.Assets {
+		if asset.ID == assetId {
+			return &asset, nil
+		}
+	}
+	return nil, ErrAssetUnknown
+}
+
+// Add a deposit address to an existing asset wallet.
+func (s *store) createAddress(vaultAccountId, assetId, description, customerRefId string) (*fb.Address, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.byID[vaultAccountId]
+	if !ok {
+		return nil, ErrVaultAccountUnknown
+	}
+	wallet, ok := account.wallets[assetId]
+	if !ok {
+		return nil, ErrAssetUnknown
+	}
+
+	fbAddress, err := s.generateAddress(assetId)
+	if err != nil {
+		return nil, err
+	}
+	fbAddress.Description = description
+	fbAddress.CustomerRefId = customerRefId
+	fbAddress.Bip44AddressIndex = len(wallet.addresses)
+	wallet.addresses = append(wallet.addresses, fbAddress)
+	return &fbAddress, nil
+}
+
+func (s *store) hideVaultAccount(vaultAccountId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.byID[vaultAccountId]
+	if !ok {
+		return ErrVaultAccountUnknown
+	}
+	account.account.HiddenOnUI = true
+	return nil
+}
+
+// Get a page of vault accounts, in creation order.
+func (s *store) vaultAccountsPage(before, after string, limit int) ([]fb.VaultAccount, fb.Paging, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	page, paging, err := paginate(s.accounts, before, after, limit, func(account *vaultAccount) string {
+		return account.account.ID
+	})
+	if err != nil {
+		return nil, paging, err
+	}
+
+	accounts := make([]fb.VaultAccount, 0, len(page))
+	for _, account := range page {
+		accounts = append(accounts, account.account)
+	}
+	return accounts, paging, nil
+}
+
+// Get a page of an asset's addresses, in creation order.
+func (s *store) addressesPage(vaultAccountId, assetId, before, after string, limit int) ([]fb.Address, fb.Paging, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.byID[vaultAccountId]
+	if !ok {
+		return nil, fb.Paging{}, ErrVaultAccountUnknown
+	}
+	wallet, ok := account.wallets[assetId]
+	if !ok {
+		return nil, fb.Paging{}, ErrAssetUnknown
+	}
+
+	page, paging, err := paginate(wallet.addresses, before, after, limit, func(address fb.Address) string {
+		return address.Address
+	})
+	return append([]fb.Address(nil), page...), paging, err
+}
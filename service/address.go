@@ -0,0 +1,270 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// How many wallets MigrateAddresses moves per transaction.
+const addressMigrationBatchSize = 500
+
+// Returned when storing an address another wallet already has.
+var ErrAddressOwned = errors.New("address belongs to another wallet")
+
+// Address is one of a wallet's deposit addresses, one per asset.
+type Address struct {
+	gorm.Model
+	WalletID uint   `gorm:"uniqueIndex:idx_wallet_asset"`
+	AssetID  string `gorm:"uniqueIndex:idx_wallet_asset"`
+	Address  string `gorm:"index"`
+	// The address as Format normalizes it, so it can be looked up however
+	// it's written.
+	NormalizedAddress string `gorm:"index:idx_addresses_normalized_address" json:"-"`
+	// Other encodings of the same address that Fireblocks gives us, e.g.
+	// a P2PKH address alongside a SegWit one, or Cardano's enterprise
+	// address. These are looked up exactly as Fireblocks gave them.
+	LegacyAddress     string `gorm:"index" json:",omitempty"`
+	EnterpriseAddress string `gorm:"index" json:",omitempty"`
+	// The tag or memo deposits need, for assets that need one.
+	Tag    string        `gorm:"index:idx_addresses_normalized_address" json:",omitempty"`
+	Format AddressFormat `json:",omitempty"`
+	// The vault wallet's status as Fireblocks reported it when we created
+	// it, e.g. whether it still needs activating.
+	Status string `json:",omitempty"`
+	// The provider's account and wallet the address is in, e.g. a Fireblocks
+	// vault account and vault wallet.
+	VaultAccountID string `json:",omitempty"`
+	VaultWalletID  string `json:",omitempty"`
+}
+
+// Keep the normalized address in step with the address. This is the only
+// place addresses are normalized; the database only checks that they are.
+func (a *Address) BeforeSave(tx *gorm.DB) error {
+	a.NormalizedAddress = a.Format.Normalize(a.Address)
+	return nil
+}
+
+// The database refuses to store an address another wallet owns, with an
+// error saying so, which we map to ErrAddressOwned.
+func mapAddressOwned(tx *gorm.DB) {
+	if tx.Error == nil || errors.Is(tx.Error, ErrAddressOwned) || !strings.Contains(tx.Error.Error(), ErrAddressOwned.Error()) {
+		return
+	}
+	// SQLite only says that much, PostgreSQL says which address too.
+	if tx.Error.Error() == ErrAddressOwned.Error() {
+		tx.Error = ErrAddressOwned
+	} else {
+		tx.Error = fmt.Errorf("%w: %s", ErrAddressOwned, tx.Error)
+	}
+}
+
+// Map errors from storing addresses, however they're stored.
+func registerAddressCallbacks(db *gorm.DB) error {
+	if err := db.Callback().Create().After("gorm:create").Register("address_manager:address_owned", mapAddressOwned); err != nil {
+		return err
+	}
+	return db.Callback().Update().After("gorm:update").Register("address_manager:address_owned", mapAddressOwned)
+}
+
+// AddressOwnership records which wallet an address (with its tag, if it has
+// one) belongs to, so it only ever belongs to one, however many of that
+// wallet's assets use it. The database claims it whenever an address is
+// stored, by its normalized form.
+type AddressOwnership struct {
+	NormalizedAddress string `gorm:"primarykey"`
+	Tag               string `gorm:"primarykey"`
+	WalletID          uint   `gorm:"not null"`
+}
+
+// A wallet as stored before addresses had their own table.
+type legacyWallet struct {
+	ID         uint
+	AddressBTC string
+	AddressSOL string
+	// JSON, from when wallets stored addresses by asset ID in a column.
+	Addresses *string
+}
+
+// An address as stored in that JSON column.
+type legacyAddress struct {
+	Address string
+	Tag     string
+}
+
+// The addresses a legacy wallet has, by asset ID.
+func (w *legacyWallet) addresses() map[string]legacyAddress {
+	addresses := make(map[string]legacyAddress)
+	if w.Addresses != nil {
+		// Best effort, the columns below cover BTC and SOL regardless.
+		json.Unmarshal([]byte(*w.Addresses), &addresses) //nolint:errcheck
+	}
+	if w.AddressBTC != "" {
+		addresses["BTC"] = legacyAddress{Address: w.AddressBTC, Tag: addresses["BTC"].Tag}
+	}
+	if w.AddressSOL != "" {
+		addresses["SOL"] = legacyAddress{Address: w.AddressSOL, Tag: addresses["SOL"].Tag}
+	}
+	return addresses
+}
+
+// Which vault account and vault wallet the journal says an address was
+// provisioned in.
+type addressProvenance struct {
+	Address        string
+	WalletID       string
+	VaultAccountID string
+}
+
+// Copy a batch of legacy wallets' addresses into the address table.
+func migrateWalletAddresses(tx *gorm.DB, wallets []legacyWallet, catalog Catalog) (int64, error) {
+	var addresses []Address
+	var values []string
+	for _, wallet := range wallets {
+		legacy := wallet.addresses()
+		for _, assetId := range slices.Sorted(maps.Keys(legacy)) {
+			address := Address{WalletID: wallet.ID, AssetID: assetId, Address: legacy[assetId].Address, Tag: legacy[assetId].Tag}
+			if asset, ok := catalog.Asset(assetId); ok {
+				address.Format = asset.AddressFormat
+			} else if asset, ok := DefaultCatalog.Asset(assetId); ok {
+				address.Format = asset.AddressFormat
+			}
+			addresses = append(addresses, address)
+			values = append(values, address.Address)
+		}
+	}
+	if len(addresses) == 0 {
+		return 0, nil
+	}
+
+	var provenance []addressProvenance
+	err := tx.Table("provisioned_assets").
+		Select("provisioned_assets.address, provisioned_assets.wallet_id, provisionings.vault_account_id").
+		Joins("JOIN provisionings ON provisionings.id = provisioned_assets.provisioning_id").
+		Where("provisioned_assets.address IN ?", values).
+		Scan(&provenance).Error
+	if err != nil {
+		return 0, err
+	}
+	byAddress := make(map[string]addressProvenance)
+	for _, p := range provenance {
+		byAddress[p.Address] = p
+	}
+	for i := range addresses {
+		if p, ok := byAddress[addresses[i].Address]; ok {
+			addresses[i].VaultAccountID = p.VaultAccountID
+			addresses[i].VaultWalletID = p.WalletID
+		}
+	}
+
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&addresses)
+	return result.RowsAffected, result.Error
+}
+
+// Copy addresses stored on wallets themselves, as wallets did before there
+// was an address table, into the address table, returning how many were
+// copied. It works in batches, skipping wallets that already have addresses
+// there, so it can run (or be interrupted and run again) while other replicas
+// keep serving.
+//
+// The old columns are left in place and still written for BTC and SOL, since
+// older replicas read them, so running this again once the last of those has
+// stopped picks up any wallets they created in the meantime.
+func MigrateAddresses(db *gorm.DB, catalog Catalog) (int64, error) {
+	columns := []string{"id", "address_btc", "address_sol"}
+	if db.Migrator().HasColumn("wallets", "addresses") {
+		columns = append(columns, "addresses")
+	}
+
+	var migrated int64
+	var lastId uint
+	for {
+		var wallets []legacyWallet
+		err := db.Table("wallets").Select(columns).
+			Where("id > ? AND id NOT IN (?)", lastId, db.Model(&Address{}).Select("wallet_id")).
+			Order("id").Limit(addressMigrationBatchSize).Find(&wallets).Error
+		if err != nil {
+			return migrated, err
+		}
+		if len(wallets) == 0 {
+			return migrated, nil
+		}
+		lastId = wallets[len(wallets)-1].ID
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			count, err := migrateWalletAddresses(tx, wallets, catalog)
+			migrated += count
+			return err
+		})
+		if err != nil {
+			return migrated, err
+		}
+	}
+}
+
+// Fill in the vault account of wallets from before we recorded it on them,
+// from their addresses, returning how many were updated.
+func MigrateVaultAccountIDs(db *gorm.DB) (int64, error) {
+	result := db.Exec(`UPDATE wallets SET vault_account_id = (
+			SELECT vault_account_id FROM addresses
+			WHERE addresses.wallet_id = wallets.id AND addresses.vault_account_id != ''
+			ORDER BY addresses.id LIMIT 1
+		)
+		WHERE (vault_account_id IS NULL OR vault_account_id = '') AND EXISTS (
+			SELECT 1 FROM addresses
+			WHERE addresses.wallet_id = wallets.id AND addresses.vault_account_id != ''
+		)`)
+	return result.RowsAffected, result.Error
+}
+
+// An address stored before addresses were normalized.
+type unnormalizedAddress struct {
+	ID      uint
+	Address string
+	Format  AddressFormat
+	Tag     string
+}
+
+// Normalize addresses stored before we did, returning how many were
+// normalized. The database claims each for its wallet as it's normalized, so
+// this fails if two wallets already share an address, which has to be
+// resolved by hand. Like MigrateAddresses, it works in batches, so it can run
+// while other replicas keep serving.
+func NormalizeAddresses(db *gorm.DB) (int64, error) {
+	var normalized int64
+	for {
+		var addresses []unnormalizedAddress
+		err := db.Model(&Address{}).Select("id", "address", "format", "coalesce(tag, '') AS tag").
+			Where("normalized_address IS NULL").
+			Order("id").Limit(addressMigrationBatchSize).Find(&addresses).Error
+		if err != nil {
+			return normalized, err
+		}
+		if len(addresses) == 0 {
+			return normalized, nil
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			for _, address := range addresses {
+				err := tx.Model(&Address{}).Where("id = ?", address.ID).UpdateColumns(map[string]any{
+					"normalized_address": address.Format.Normalize(address.Address),
+					"tag":                address.Tag,
+				}).Error
+				if err != nil {
+					return fmt.Errorf("failed to normalize address %s: %w", address.Address, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return normalized, err
+		}
+		normalized += int64(len(addresses))
+	}
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// How an asset's addresses are written, which is what tells us how to
+// compare them.
+type AddressFormat string
+
+const (
+	// Bitcoin SegWit and Taproot addresses.
+	FormatBech32 AddressFormat = "bech32"
+	// e.g. Solana public keys.
+	FormatBase58 AddressFormat = "base58"
+	// e.g. Ethereum, 0x-prefixed.
+	FormatHex AddressFormat = "hex"
+)
+
+// Whether addresses in this format mean the same regardless of case, as
+// bech32 and hex addresses do (e.g. EIP-55 addresses are mixed case only as a
+// checksum), but base58 ones don't.
+func (f AddressFormat) CaseInsensitive() bool {
+	return f == FormatBech32 || f == FormatHex
+}
+
+// The form of an address we compare and index, so the same address written
+// differently is still found, and still unique.
+func (f AddressFormat) Normalize(address string) string {
+	if f.CaseInsensitive() {
+		return strings.ToLower(address)
+	}
+	return address
+}
+
+// An asset we give users addresses for.
+type Asset struct {
+	// Our ID for the asset, which is what the API uses.
+	ID string `json:"id"`
+	// The asset as Fireblocks knows it, e.g. BTC_TEST for testnet Bitcoin.
+	// Defaults to ID.
+	FireblocksID  string        `json:"fireblocks_id,omitempty"`
+	Chain         string        `json:"chain"`
+	AddressFormat AddressFormat `json:"address_format"`
+	// Whether deposits need a tag or memo as well as the address, e.g. XRP,
+	// so it has to be shown to the user.
+	NeedsTag bool `json:"needs_tag,omitempty"`
+	// Disabled assets aren't provisioned for new wallets, but addresses
+	// that existing wallets have for them are kept.
+	Enabled bool `json:"enabled"`
+}
+
+// Catalog is every asset we know about.
+type Catalog []Asset
+
+// What we provision when no catalog is configured.
+var DefaultCatalog = Catalog{
+	{ID: "BTC", FireblocksID: "BTC", Chain: "bitcoin", AddressFormat: FormatBech32, Enabled: true},
+	{ID: "SOL", FireblocksID: "SOL", Chain: "solana", AddressFormat: FormatBase58, Enabled: true},
+}
+
+// The catalog in the file ASSET_CATALOG names, or DefaultCatalog if it's
+// unset.
+func catalogFromEnv() (Catalog, error) {
+	if path := os.Getenv("ASSET_CATALOG"); path != "" {
+		return LoadCatalog(path)
+	}
+	return DefaultCatalog, nil
+}
+
+// Load a catalog from a JSON file holding a list of assets.
+func LoadCatalog(path string) (Catalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var catalog Catalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("failed to parse asset catalog %s: %w", path, err)
+	}
+	for i := range catalog {
+		if catalog[i].FireblocksID == "" {
+			catalog[i].FireblocksID = catalog[i].ID
+		}
+	}
+	if err := catalog.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid asset catalog %s: %w", path, err)
+	}
+	return catalog, nil
+}
+
+// Check every asset is fully described, and only once.
+func (c Catalog) Validate() error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, asset := range c {
+		if asset.ID == "" {
+			errs = append(errs, fmt.Errorf("asset %d has no ID", i))
+			continue
+		}
+		if seen[asset.ID] {
+			errs = append(errs, fmt.Errorf("asset %s is listed more than once", asset.ID))
+		}
+		seen[asset.ID] = true
+		if asset.Chain == "" {
+			errs = append(errs, fmt.Errorf("asset %s has no chain", asset.ID))
+		}
+		if !slices.Contains([]AddressFormat{FormatBech32, FormatBase58, FormatHex}, asset.AddressFormat) {
+			errs = append(errs, fmt.Errorf("asset %s has unknown address format %q", asset.ID, asset.AddressFormat))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// The assets new wallets get.
+func (c Catalog) Enabled() []Asset {
+	var enabled []Asset
+	for _, asset := range c {
+		if asset.Enabled {
+			enabled = append(enabled, asset)
+		}
+	}
+	return enabled
+}
+
+// Look up an asset by our ID.
+func (c Catalog) Asset(id string) (Asset, bool) {
+	i := slices.IndexFunc(c, func(asset Asset) bool { return asset.ID == id })
+	if i < 0 {
+		return Asset{}, false
+	}
+	return c[i], true
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Where the database is and how we connect to it.
+type DatabaseConfig struct {
+	// A PostgreSQL URL, i.e. postgres://..., or otherwise the SQLite database
+	// file (with any options, e.g. adhoc.db?_busy_timeout=5000).
+	DSN string
+	// Connection pool settings. Zero leaves database/sql's default.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// Whether the DSN is for PostgreSQL rather than SQLite.
+func (c DatabaseConfig) IsPostgres() bool {
+	return strings.HasPrefix(c.DSN, "postgres://") || strings.HasPrefix(c.DSN, "postgresql://")
+}
+
+// Configure the database from DATABASE_URL (defaulting to SQLite in the
+// working directory) and DATABASE_MAX_OPEN_CONNS, DATABASE_MAX_IDLE_CONNS,
+// DATABASE_CONN_MAX_LIFETIME and DATABASE_CONN_MAX_IDLE_TIME.
+func DatabaseConfigFromEnv() (DatabaseConfig, error) {
+	config := DatabaseConfig{
+		DSN:             databaseDSN,
+		MaxOpenConns:    20,
+		MaxIdleConns:    10,
+		ConnMaxLifetime: 30 * time.Minute,
+		ConnMaxIdleTime: 5 * time.Minute,
+	}
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		config.DSN = dsn
+	}
+
+	for name, value := range map[string]*int{
+		"DATABASE_MAX_OPEN_CONNS": &config.MaxOpenConns,
+		"DATABASE_MAX_IDLE_CONNS": &config.MaxIdleConns,
+	} {
+		if s := os.Getenv(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return config, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*value = n
+		}
+	}
+	for name, value := range map[string]*time.Duration{
+		"DATABASE_CONN_MAX_LIFETIME":  &config.ConnMaxLifetime,
+		"DATABASE_CONN_MAX_IDLE_TIME": &config.ConnMaxIdleTime,
+	} {
+		if s := os.Getenv(name); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return config, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*value = d
+		}
+	}
+	return config, nil
+}
+
+// Connect to the configured database, PostgreSQL or SQLite.
+func OpenDatabase(config DatabaseConfig) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	if config.IsPostgres() {
+		dialector = postgres.Open(config.DSN)
+	} else {
+		dialector = sqlite.Open(config.DSN)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := registerAddressCallbacks(db); err != nil {
+		return nil, err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxOpenConns != 0 {
+		sqlDB.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns != 0 {
+		sqlDB.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime != 0 {
+		sqlDB.SetConnMaxLifetime(config.ConnMaxLifetime)
+	}
+	if config.ConnMaxIdleTime != 0 {
+		sqlDB.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+	}
+	return db, nil
+}
@@ -0,0 +1,162 @@
+package fireblocks
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Fireblocks rejects tokens that live longer than this.
+const tokenLifetime = 30 * time.Second
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// API credentials. See
+// https://developers.fireblocks.com/reference/signing-a-request-jwt-structure.
+type Credentials struct {
+	APIKey     string
+	PrivateKey *rsa.PrivateKey
+}
+
+// Load credentials, with the private key read from a PEM file.
+func LoadCredentials(apiKey, privateKeyFile string) (*Credentials, error) {
+	data, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", privateKeyFile)
+	}
+
+	var privateKey *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var key any
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if privateKey, ok = key.(*rsa.PrivateKey); !ok {
+				err = fmt.Errorf("%s is not an RSA key", privateKeyFile)
+			}
+		}
+	default:
+		err = fmt.Errorf("unexpected PEM block %q in %s", block.Type, privateKeyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credentials{APIKey: apiKey, PrivateKey: privateKey}, nil
+}
+
+// Claims in a Fireblocks request JWT.
+type Claims struct {
+	// Path and query of the request, e.g. "/v1/vault/accounts?limit=1".
+	URI      string `json:"uri"`
+	Nonce    string `json:"nonce"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+	// The API key.
+	Subject string `json:"sub"`
+	// Hex-encoded SHA-256 of the request body.
+	BodyHash string `json:"bodyHash"`
+}
+
+// Hex-encoded SHA-256 of a request body, as expected in Claims.BodyHash.
+func BodyHash(body []byte) string {
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+
+// Sign a JWT for a request to uri with the given body.
+func (c *Credentials) SignRequest(uri string, body []byte) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		URI:      uri,
+		Nonce:    uuid.NewString(),
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(tokenLifetime).Unix(),
+		Subject:  c.APIKey,
+		BodyHash: BodyHash(body),
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(nil, c.PrivateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify a request JWT's signature and expiry, returning its claims. It's up
+// to the caller to check the claims match the request.
+func VerifyToken(token string, publicKey *rsa.PublicKey) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts, got %d", ErrInvalidToken, len(parts))
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	var alg struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &alg); err != nil || alg.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm", ErrInvalidToken)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+
+	now := time.Now().Unix()
+	if claims.Expiry < now {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if claims.Expiry-claims.IssuedAt > int64(tokenLifetime.Seconds()) {
+		return nil, fmt.Errorf("%w: lifetime too long", ErrInvalidToken)
+	}
+
+	return &claims, nil
+}
@@ -0,0 +1,127 @@
+package fireblocks_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fionn/address-manager/fb_mock"
+	"github.com/fionn/address-manager/service/fireblocks"
+)
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Write the key to a PKCS8 PEM file and load credentials from it.
+func loadCredentials(t *testing.T, apiKey string, key *rsa.PrivateKey) *fireblocks.Credentials {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "fireblocks.key")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials, err := fireblocks.LoadCredentials(apiKey, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return credentials
+}
+
+func TestSignRequest(t *testing.T) {
+	key := generateKey(t)
+	credentials := loadCredentials(t, "api-key", key)
+
+	body := []byte(`{"name":"test"}`)
+	token, err := credentials.SignRequest("/v1/vault/accounts", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := fireblocks.VerifyToken(token, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.URI != "/v1/vault/accounts" || claims.Subject != "api-key" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if claims.BodyHash != fireblocks.BodyHash(body) {
+		t.Errorf("body hash %s doesn't match body", claims.BodyHash)
+	}
+	if claims.Nonce == "" {
+		t.Error("missing nonce")
+	}
+
+	if _, err := fireblocks.VerifyToken(token, &generateKey(t).PublicKey); !errors.Is(err, fireblocks.ErrInvalidToken) {
+		t.Errorf("verified with the wrong key: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	other, err := credentials.SignRequest("/v1/vault/accounts/1/BTC", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts[1] = strings.Split(other, ".")[1]
+	if _, err := fireblocks.VerifyToken(strings.Join(parts, "."), &key.PublicKey); !errors.Is(err, fireblocks.ErrInvalidToken) {
+		t.Errorf("verified a tampered token: %v", err)
+	}
+}
+
+func TestAuthenticatedSession(t *testing.T) {
+	key := generateKey(t)
+	config := fb_mock.Config{PublicKey: &key.PublicKey, APIKey: "api-key"}
+	ctx := context.Background()
+
+	newSession := func(options ...fireblocks.Option) *fireblocks.Fireblocks {
+		t.Helper()
+		fb, err := fireblocks.NewFireblocksSession("http://"+authMockHost, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fb
+	}
+
+	fb := startMock(t, authMockHost, config, fireblocks.WithCredentials(loadCredentials(t, "api-key", key)))
+	account, err := fb.CreateVaultAccount(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fb.CreateVaultAccountAsset(ctx, account.ID, "BTC", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fb.ListVaultAccountsPaged(ctx, fireblocks.PageRequest{Limit: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	unauthenticated := newSession()
+	if _, err := unauthenticated.CreateVaultAccount(ctx, ""); err == nil {
+		t.Error("unauthenticated request succeeded")
+	}
+
+	wrongKey := newSession(fireblocks.WithCredentials(loadCredentials(t, "api-key", generateKey(t))))
+	if _, err := wrongKey.CreateVaultAccount(ctx, ""); err == nil {
+		t.Error("request signed with the wrong key succeeded")
+	}
+
+	wrongAPIKey := newSession(fireblocks.WithCredentials(loadCredentials(t, "other", key)))
+	if _, err := wrongAPIKey.CreateVaultAccount(ctx, ""); err == nil {
+		t.Error("request with the wrong API key succeeded")
+	}
+}
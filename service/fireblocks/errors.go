@@ -0,0 +1,87 @@
+package fireblocks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// See https://developers.fireblocks.com/reference/api-responses#api-error-codes.
+const codeUnknownAsset = 1006
+
+// Sentinels for well-known errors, for use with errors.Is on an *Error.
+var (
+	ErrUnknownAsset = errors.New("unknown asset")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+)
+
+// Error is returned when Fireblocks responds with a non-2xx status. The code
+// and message are decoded from the response body, if it has them.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       int    `json:"error_code,omitempty"`
+	Message    string `json:"message"`
+	// How long the server asked us to wait before retrying, for 429s.
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("unexpected status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Code != 0 {
+		s += fmt.Sprintf(" (error code %d)", e.Code)
+	}
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrUnknownAsset:
+		return e.Code == codeUnknownAsset
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	default:
+		return false
+	}
+}
+
+// Check a response's status code, returning an *Error decoded from the body
+// if it's not 2xx.
+func checkStatus(response *http.Response) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+
+	apiErr := &Error{StatusCode: response.StatusCode}
+	if response.StatusCode == http.StatusTooManyRequests {
+		retryAfter, ok := parseRetryAfter(response.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			retryAfter = defaultRetryAfter
+		}
+		apiErr.RetryAfter = retryAfter
+	}
+	// Error bodies are small; don't let a misbehaving server make us read a
+	// big one.
+	body, err := io.ReadAll(io.LimitReader(response.Body, 64<<10))
+	if err != nil {
+		return apiErr
+	}
+	if json.Unmarshal(body, apiErr) != nil {
+		// Not the usual shape, e.g. from a proxy in front of Fireblocks.
+		apiErr.Code = 0
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
@@ -0,0 +1,92 @@
+package fireblocks_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fionn/address-manager/service/fireblocks"
+)
+
+func TestError(t *testing.T) {
+	cases := []struct {
+		status  int
+		body    string
+		code    int
+		message string
+		is      []error
+		isNot   []error
+	}{
+		{
+			status:  http.StatusNotFound,
+			body:    `{"error_code":1006,"message":"Asset doesn't exist"}`,
+			code:    1006,
+			message: "Asset doesn't exist",
+			is:      []error{fireblocks.ErrUnknownAsset, fireblocks.ErrNotFound},
+			isNot:   []error{fireblocks.ErrRateLimited, fireblocks.ErrUnauthorized},
+		},
+		{
+			status:  http.StatusNotFound,
+			body:    `{"error_code":11001,"message":"The Provided Vault Account ID is invalid"}`,
+			code:    11001,
+			message: "The Provided Vault Account ID is invalid",
+			is:      []error{fireblocks.ErrNotFound},
+			isNot:   []error{fireblocks.ErrUnknownAsset},
+		},
+		{
+			// With Retry-After: 0 so we don't wait between retries.
+			status: http.StatusTooManyRequests,
+			body:   `{"message":"Too many requests"}`,
+			is:     []error{fireblocks.ErrRateLimited},
+			isNot:  []error{fireblocks.ErrNotFound},
+		},
+		{
+			// Not the Fireblocks shape, so we keep the body as the message.
+			status:  http.StatusUnauthorized,
+			body:    "Unauthorized\n",
+			message: "Unauthorized",
+			is:      []error{fireblocks.ErrUnauthorized},
+			isNot:   []error{fireblocks.ErrRateLimited},
+		},
+	}
+
+	for _, c := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c.status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "0")
+			}
+			w.WriteHeader(c.status)
+			w.Write([]byte(c.body))
+		}))
+
+		fb, err := fireblocks.NewFireblocksSession(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fb.CreateVaultAccountAsset(context.Background(), "1", "BTC", "")
+		server.Close()
+
+		var apiErr *fireblocks.Error
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("expected *fireblocks.Error for %d %s, got %v", c.status, c.body, err)
+		}
+		if apiErr.StatusCode != c.status || apiErr.Code != c.code {
+			t.Errorf("expected status %d and code %d, got %d and %d", c.status, c.code, apiErr.StatusCode, apiErr.Code)
+		}
+		if c.message != "" && apiErr.Message != c.message {
+			t.Errorf("expected message %q, got %q", c.message, apiErr.Message)
+		}
+		for _, target := range c.is {
+			if !errors.Is(err, target) {
+				t.Errorf("expected %v to be %v", err, target)
+			}
+		}
+		for _, target := range c.isNot {
+			if errors.Is(err, target) {
+				t.Errorf("expected %v not to be %v", err, target)
+			}
+		}
+	}
+}
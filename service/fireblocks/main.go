@@ -1,13 +1,22 @@
 package fireblocks
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"time"
 )
 
+// How long a request may take, including reading the response, unless
+// overridden with WithTimeout or WithHTTPClient.
+const defaultTimeout = 30 * time.Second
+
 // Fireblocks address object, embedded in FBAddresses.
-// Only used in mocks.
 type Address struct {
 	AssetId           string `json:"assetId"`
 	Address           string `json:"address"`
@@ -22,11 +31,11 @@ type Address struct {
 	UserDefined       bool   `json:"userDefined"`
 }
 
-// Fireblocks addresses object, wrapping an array of address objects.
+// Fireblocks addresses object, wrapping a page of address objects.
 // See https://developers.fireblocks.com/reference/getvaultaccountassetaddressespaginated.
-// Only used in mocks.
 type Addresses struct {
 	Addresses []Address `json:"addresses"`
+	Paging    Paging    `json:"paging"`
 }
 
 // Fireblocks vault asset, embedded in FBVaultAccount.
@@ -53,6 +62,13 @@ type VaultAccount struct {
 	AutoFuel      string       `json:"autoFuel"`
 }
 
+// A page of vault accounts, see
+// https://developers.fireblocks.com/reference/getpagedvaultaccounts.
+type VaultAccountsPaged struct {
+	Accounts []VaultAccount `json:"accounts"`
+	Paging   Paging         `json:"paging"`
+}
+
 // Wallet object returned from
 // https://developers.fireblocks.com/reference/createvaultaccountasset.
 type VaultWallet struct {
@@ -66,57 +82,280 @@ type VaultWallet struct {
 	ActivationTxId    string `json:"activationTxId,omitempty"`
 }
 
+// Response to creating a deposit address, see
+// https://developers.fireblocks.com/reference/createvaultaccountassetaddress.
+type CreatedAddress struct {
+	Address           string `json:"address"`
+	LegacyAddress     string `json:"legacyAddress,omitempty"`
+	EnterpriseAddress string `json:"enterpriseAddress,omitempty"`
+	Tag               string `json:"tag,omitempty"`
+	Bip44AddressIndex int    `json:"bip44AddressIndex"`
+}
+
+// Optional fields when creating a deposit address.
+type CreateAddressRequest struct {
+	Description   string `json:"description,omitempty"`
+	CustomerRefId string `json:"customerRefId,omitempty"`
+}
+
 type Fireblocks struct {
-	baseURL url.URL
-	// We would put a credentials field in here too.
+	baseURL     url.URL
+	credentials *Credentials
+	client      *http.Client
+	userAgent   string
+	limiters    map[EndpointClass]*TokenBucket
+}
+
+// Option configures a Fireblocks session.
+type Option func(*Fireblocks)
+
+// Authenticate requests with the given credentials. Without this, requests
+// are unauthenticated, which only the mock accepts.
+func WithCredentials(credentials *Credentials) Option {
+	return func(fb *Fireblocks) {
+		fb.credentials = credentials
+	}
+}
+
+// Make requests with the given client rather than a default one, e.g. to
+// configure the transport.
+func WithHTTPClient(client *http.Client) Option {
+	return func(fb *Fireblocks) {
+		fb.client = client
+	}
+}
+
+// Bound how long each request may take. Zero means no timeout, which is only
+// sensible if every context passed in has a deadline. This applies to the
+// client at the time, so comes after WithHTTPClient.
+func WithTimeout(timeout time.Duration) Option {
+	return func(fb *Fireblocks) {
+		// Copy so we don't change a client passed to WithHTTPClient under
+		// whoever else is using it.
+		client := *fb.client
+		client.Timeout = timeout
+		fb.client = &client
+	}
+}
+
+// Limit requests of the given class to rate per second, in bursts of up to
+// burst. Without this, requests are only held back after a 429. Sessions made
+// with the same option share the limit.
+func WithRateLimit(class EndpointClass, rate float64, burst int) Option {
+	limiter := NewTokenBucket(rate, burst)
+	return func(fb *Fireblocks) {
+		fb.limiters[class] = limiter
+	}
 }
 
-// Placeholder for Fireblocks session constructor. We'll need this to pass
-// credentials through, but currently aren't concerned with that, this is just
-// so we get the general shape right.
-func NewFireblocksSession(baseURL string) Fireblocks {
-	fbURL, _ := url.Parse(baseURL)
-	return Fireblocks{baseURL: *fbURL}
+// Send the given User-Agent header with each request.
+func WithUserAgent(userAgent string) Option {
+	return func(fb *Fireblocks) {
+		fb.userAgent = userAgent
+	}
 }
 
-func (fb *Fireblocks) CreateVaultAccount() (*VaultAccount, error) {
-	createAccountURL, _ := url.JoinPath(fb.baseURL.String(), "/v1/vault/accounts")
-	request, err := http.NewRequest(http.MethodPost, createAccountURL, nil)
+// Create a session for the Fireblocks API at baseURL, which must be an
+// absolute http or https URL.
+func NewFireblocksSession(baseURL string, options ...Option) (*Fireblocks, error) {
+	fbURL, err := url.Parse(baseURL)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if fbURL.Scheme != "http" && fbURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL %q: scheme must be http or https", baseURL)
+	}
+	if fbURL.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %q: missing host", baseURL)
+	}
+
+	fb := Fireblocks{
+		baseURL: *fbURL,
+		client:  &http.Client{Timeout: defaultTimeout},
+		limiters: map[EndpointClass]*TokenBucket{
+			ClassRead:  NewTokenBucket(0, 0),
+			ClassWrite: NewTokenBucket(0, 0),
+		},
+	}
+	for _, option := range options {
+		option(&fb)
+	}
+	return &fb, nil
+}
+
+// Make a request to the Fireblocks API, signing it if we have credentials,
+// and decode the JSON response into out if it's non-nil. Any extra headers
+// are added to the request. Requests wait their turn under the rate limit,
+// and a 429 holds back every request of its class for as long as the server
+// asks before we retry.
+func (fb *Fireblocks) do(ctx context.Context, method string, endpoint *url.URL, header http.Header, body []byte, out any) error {
+	class := classOf(method)
+	limiter := fb.limiters[class]
+	for attempt := 0; ; attempt++ {
+		wait, err := limiter.Wait(ctx)
+		RateLimitWait.AddFloat(string(class), wait.Seconds())
+		if err != nil {
+			return err
+		}
+
+		err = fb.send(ctx, method, endpoint, header, body, out)
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+			return err
+		}
+		RateLimited.Add(string(class), 1)
+		limiter.Pause(time.Now().Add(apiErr.RetryAfter))
+		if attempt >= maxRateLimitRetries {
+			return err
+		}
 	}
+}
 
-	response, err := http.DefaultClient.Do(request)
+// Make a single request. See do.
+func (fb *Fireblocks) send(ctx context.Context, method string, endpoint *url.URL, header http.Header, body []byte, out any) error {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, endpoint.String(), bodyReader)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
 	}
+	if fb.userAgent != "" {
+		request.Header.Set("User-Agent", fb.userAgent)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	if fb.credentials != nil {
+		token, err := fb.credentials.SignRequest(request.URL.RequestURI(), body)
+		if err != nil {
+			return fmt.Errorf("failed to sign request: %w", err)
+		}
+		request.Header.Set("X-API-Key", fb.credentials.APIKey)
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := fb.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := checkStatus(response); err != nil {
+		return err
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
 
+// Header to make a request idempotent, so retrying it with the same key
+// returns the original response rather than acting again. An empty key means
+// no header.
+func idempotencyHeader(idempotencyKey string) http.Header {
+	if idempotencyKey == "" {
+		return nil
+	}
+	return http.Header{"Idempotency-Key": {idempotencyKey}}
+}
+
+// Create a vault account. Retrying with the same idempotency key won't create
+// another one.
+func (fb *Fireblocks) CreateVaultAccount(ctx context.Context, idempotencyKey string) (*VaultAccount, error) {
 	var fbVaultAccount VaultAccount
-	err = json.NewDecoder(response.Body).Decode(&fbVaultAccount)
+	endpoint := fb.baseURL.JoinPath("/v1/vault/accounts")
+	err := fb.do(ctx, http.MethodPost, endpoint, idempotencyHeader(idempotencyKey), nil, &fbVaultAccount)
 	if err != nil {
 		return nil, err
 	}
-
 	return &fbVaultAccount, nil
 }
 
-func (fb *Fireblocks) CreateVaultAccountAsset(accountId, assetId string) (*VaultWallet, error) {
-	createAssetURL, _ := url.JoinPath(fb.baseURL.String(), "/v1/vault/accounts/", accountId, assetId)
-	request, err := http.NewRequest(http.MethodPost, createAssetURL, nil)
+// Create an asset wallet in a vault account. Retrying with the same
+// idempotency key won't create another one.
+func (fb *Fireblocks) CreateVaultAccountAsset(ctx context.Context, accountId, assetId, idempotencyKey string) (*VaultWallet, error) {
+	var fbVaultWallet VaultWallet
+	endpoint := fb.baseURL.JoinPath("/v1/vault/accounts/", accountId, assetId)
+	err := fb.do(ctx, http.MethodPost, endpoint, idempotencyHeader(idempotencyKey), nil, &fbVaultWallet)
 	if err != nil {
 		return nil, err
 	}
+	return &fbVaultWallet, nil
+}
 
-	response, err := http.DefaultClient.Do(request)
-	if err != nil {
+// Hide a vault account from the console. See
+// https://developers.fireblocks.com/reference/hidevaultaccount.
+func (fb *Fireblocks) HideVaultAccount(ctx context.Context, accountId string) error {
+	return fb.do(ctx, http.MethodPost, fb.baseURL.JoinPath("/v1/vault/accounts/", accountId, "hide"), nil, nil, nil)
+}
+
+// Get a page of vault accounts. See VaultAccounts to iterate over all of
+// them.
+func (fb *Fireblocks) ListVaultAccountsPaged(ctx context.Context, page PageRequest) (*VaultAccountsPaged, error) {
+	endpoint := fb.baseURL.JoinPath("/v1/vault/accounts_paged")
+	endpoint.RawQuery = page.query().Encode()
+
+	var accounts VaultAccountsPaged
+	if err := fb.do(ctx, http.MethodGet, endpoint, nil, nil, &accounts); err != nil {
 		return nil, err
 	}
+	return &accounts, nil
+}
 
-	var fbVaultWallet VaultWallet
-	err = json.NewDecoder(response.Body).Decode(&fbVaultWallet)
+// Get a page of the addresses of a vault account's asset. See
+// VaultAccountAssetAddresses to iterate over all of them.
+func (fb *Fireblocks) GetVaultAccountAssetAddresses(ctx context.Context, accountId, assetId string, page PageRequest) (*Addresses, error) {
+	endpoint := fb.baseURL.JoinPath("/v1/vault/accounts/", accountId, assetId, "addresses_paginated")
+	endpoint.RawQuery = page.query().Encode()
+
+	var addresses Addresses
+	if err := fb.do(ctx, http.MethodGet, endpoint, nil, nil, &addresses); err != nil {
+		return nil, err
+	}
+	return &addresses, nil
+}
+
+// Get a vault account by ID. See
+// https://developers.fireblocks.com/reference/getvaultaccount.
+func (fb *Fireblocks) GetVaultAccount(ctx context.Context, accountId string) (*VaultAccount, error) {
+	var account VaultAccount
+	endpoint := fb.baseURL.JoinPath("/v1/vault/accounts/", accountId)
+	if err := fb.do(ctx, http.MethodGet, endpoint, nil, nil, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// Get a vault account's asset, including its balance. See
+// https://developers.fireblocks.com/reference/getvaultaccountasset.
+func (fb *Fireblocks) GetVaultAccountAsset(ctx context.Context, accountId, assetId string) (*VaultAsset, error) {
+	var asset VaultAsset
+	endpoint := fb.baseURL.JoinPath("/v1/vault/accounts/", accountId, assetId)
+	if err := fb.do(ctx, http.MethodGet, endpoint, nil, nil, &asset); err != nil {
+		return nil, err
+	}
+	return &asset, nil
+}
+
+// Create an additional deposit address for an existing vault account asset.
+// Retrying with the same idempotency key won't create another one. See
+// https://developers.fireblocks.com/reference/createvaultaccountassetaddress.
+func (fb *Fireblocks) CreateVaultAccountAssetAddress(ctx context.Context, accountId, assetId string, request CreateAddressRequest, idempotencyKey string) (*CreatedAddress, error) {
+	body, err := json.Marshal(request)
 	if err != nil {
 		return nil, err
 	}
 
-	return &fbVaultWallet, nil
+	var address CreatedAddress
+	endpoint := fb.baseURL.JoinPath("/v1/vault/accounts/", accountId, assetId, "addresses")
+	if err := fb.do(ctx, http.MethodPost, endpoint, idempotencyHeader(idempotencyKey), body, &address); err != nil {
+		return nil, err
+	}
+	return &address, nil
 }
@@ -0,0 +1,275 @@
+package fireblocks_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fionn/address-manager/fb_mock"
+	"github.com/fionn/address-manager/service/fireblocks"
+)
+
+// Apart from the service tests' mock, since packages are tested in parallel.
+const (
+	authMockHost        = "localhost:6202"
+	idempotencyMockHost = "localhost:6203"
+	readMockHost        = "localhost:6204"
+	pagingMockHost      = "localhost:6205"
+	rateLimitMockHost   = "localhost:6206"
+	latencyMockHost     = "localhost:6207"
+)
+
+// Start a mock on the given address, returning a session for it once it's
+// listening. It's stopped when the test finishes.
+func startMock(t *testing.T, address string, config fb_mock.Config, options ...fireblocks.Option) *fireblocks.Fireblocks {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go fb_mock.RunWithConfig(ctx, &wg, address, config)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fb, err := fireblocks.NewFireblocksSession("http://"+address, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fb
+}
+
+func TestNewFireblocksSession(t *testing.T) {
+	for _, baseURL := range []string{"", "localhost:6200", "ftp://localhost", "http://", "http://%zz"} {
+		if _, err := fireblocks.NewFireblocksSession(baseURL); err == nil {
+			t.Errorf("expected %q to be rejected", baseURL)
+		}
+	}
+	for _, baseURL := range []string{"http://localhost:6200", "https://api.fireblocks.io"} {
+		if _, err := fireblocks.NewFireblocksSession(baseURL); err != nil {
+			t.Errorf("expected %q to be accepted: %s", baseURL, err)
+		}
+	}
+}
+
+// A server that doesn't respond until the client gives up.
+func hangingServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCancellation(t *testing.T) {
+	fb, err := fireblocks.NewFireblocksSession(hangingServer(t).URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := fb.CreateVaultAccount(ctx, ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	fb, err := fireblocks.NewFireblocksSession(hangingServer(t).URL, fireblocks.WithTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fb.CreateVaultAccount(context.Background(), "")
+	if err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if !fireblocks.IsRetryable(err) {
+		t.Errorf("expected timeout %v to be retryable", err)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	userAgent := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent <- r.UserAgent()
+		w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer server.Close()
+
+	client := &http.Client{}
+	fb, err := fireblocks.NewFireblocksSession(server.URL,
+		fireblocks.WithHTTPClient(client),
+		fireblocks.WithTimeout(time.Second),
+		fireblocks.WithUserAgent("address-manager-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fb.CreateVaultAccount(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-userAgent; got != "address-manager-test" {
+		t.Errorf("expected user agent address-manager-test, got %q", got)
+	}
+	if client.Timeout != 0 {
+		t.Error("WithTimeout modified the client passed to WithHTTPClient")
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	fb := startMock(t, idempotencyMockHost, fb_mock.Config{})
+	ctx := context.Background()
+
+	first, err := fb.CreateVaultAccount(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried, err := fb.CreateVaultAccount(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.ID != first.ID {
+		t.Errorf("retry created vault account %s, expected %s", retried.ID, first.ID)
+	}
+
+	other, err := fb.CreateVaultAccount(ctx, "other key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == first.ID {
+		t.Error("different keys returned the same vault account")
+	}
+
+	_, err = fb.CreateVaultAccountAsset(ctx, first.ID, "BTC", "key")
+	var apiErr *fireblocks.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected reusing a key for a different request to be rejected, got %v", err)
+	}
+
+	page, err := fb.ListVaultAccountsPaged(ctx, fireblocks.PageRequest{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Accounts) != 2 {
+		t.Errorf("found %d vault accounts, expected 2", len(page.Accounts))
+	}
+}
+
+func TestIdempotencyKeyAfterTimeout(t *testing.T) {
+	fb := startMock(t, latencyMockHost, fb_mock.Config{Latency: 200 * time.Millisecond}, fireblocks.WithTimeout(50*time.Millisecond))
+	ctx := context.Background()
+
+	_, err := fb.CreateVaultAccount(ctx, "key")
+	if !fireblocks.IsRetryable(err) {
+		t.Fatalf("expected a retryable timeout, got %v", err)
+	}
+
+	// The first request is still being handled, which is no reason to give
+	// up.
+	_, err = fb.CreateVaultAccount(ctx, "key")
+	var apiErr *fireblocks.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Fatalf("expected the request to be in progress, got %v", err)
+	}
+	if !fireblocks.IsRetryable(err) {
+		t.Errorf("expected %v to be retryable", err)
+	}
+
+	policy := fireblocks.RetryPolicy{MaxAttempts: 20, BaseDelay: 20 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	var account *fireblocks.VaultAccount
+	err = policy.Do(ctx, func(ctx context.Context) error {
+		var err error
+		account, err = fb.CreateVaultAccount(ctx, "key")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("retrying failed: %s", err)
+	}
+
+	page, err := fb.ListVaultAccountsPaged(ctx, fireblocks.PageRequest{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Accounts) != 1 || page.Accounts[0].ID != account.ID {
+		t.Errorf("expected only vault account %s, found %+v", account.ID, page.Accounts)
+	}
+}
+
+func TestReadVaultAccount(t *testing.T) {
+	fb := startMock(t, readMockHost, fb_mock.Config{})
+	ctx := context.Background()
+
+	created, err := fb.CreateVaultAccount(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := fb.CreateVaultAccountAsset(ctx, created.ID, "BTC", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := fb.GetVaultAccount(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.ID != created.ID || len(account.Assets) != 1 {
+		t.Errorf("expected vault account %s with only its BTC asset, got %+v", created.ID, account)
+	}
+
+	// Creating an asset again is refused, rather than replacing it.
+	var apiErr *fireblocks.Error
+	if _, err := fb.CreateVaultAccountAsset(ctx, created.ID, "BTC", ""); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected creating BTC again to fail with %d, got %v", http.StatusBadRequest, err)
+	}
+	if account, err := fb.GetVaultAccount(ctx, created.ID); err != nil || len(account.Assets) != 1 {
+		t.Errorf("expected vault account %s to still have 1 asset, got %+v, %v", created.ID, account, err)
+	}
+	if _, err := fb.GetVaultAccount(ctx, "unknown"); !errors.Is(err, fireblocks.ErrNotFound) {
+		t.Errorf("expected unknown vault account not to be found, got %v", err)
+	}
+
+	asset, err := fb.GetVaultAccountAsset(ctx, created.ID, "BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asset.ID != "BTC" || asset.Total != "0" {
+		t.Errorf("expected an empty BTC asset, got %+v", asset)
+	}
+	if _, err := fb.GetVaultAccountAsset(ctx, created.ID, "SOL"); !errors.Is(err, fireblocks.ErrUnknownAsset) {
+		t.Errorf("expected SOL to be unknown, got %v", err)
+	}
+
+	address, err := fb.CreateVaultAccountAssetAddress(ctx, created.ID, "BTC", fireblocks.CreateAddressRequest{Description: "second"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.Address == "" || address.Address == wallet.Address || address.Bip44AddressIndex != 1 {
+		t.Errorf("expected a new address at index 1, got %+v", address)
+	}
+
+	addresses, err := fb.GetVaultAccountAssetAddresses(ctx, created.ID, "BTC", fireblocks.PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses.Addresses) != 2 {
+		t.Fatalf("expected 2 addresses, got %d", len(addresses.Addresses))
+	}
+	if got := addresses.Addresses[1]; got.Address != address.Address || got.Description != "second" {
+		t.Errorf("expected the new address, got %+v", got)
+	}
+}
@@ -0,0 +1,97 @@
+package fireblocks
+
+import (
+	"context"
+	"iter"
+	"net/url"
+	"strconv"
+)
+
+// Cursors for paged list endpoints. They're opaque, and empty when there's no
+// page in that direction.
+type Paging struct {
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// Which page of a list endpoint to get. With no cursors it's the first page,
+// and with no limit it's as many as the endpoint returns by default.
+type PageRequest struct {
+	Before string
+	After  string
+	Limit  int
+}
+
+func (p PageRequest) query() url.Values {
+	query := url.Values{}
+	if p.Before != "" {
+		query.Set("before", p.Before)
+	}
+	if p.After != "" {
+		query.Set("after", p.After)
+	}
+	if p.Limit > 0 {
+		query.Set("limit", strconv.Itoa(p.Limit))
+	}
+	return query
+}
+
+// Iterate over every item of a list endpoint, fetching pageSize at a time
+// and following the after cursor until there are no more. An error, including
+// the context being cancelled, is yielded once and ends the iteration.
+func paginate[T any](ctx context.Context, pageSize int, fetch func(context.Context, PageRequest) ([]T, Paging, error)) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		page := PageRequest{Limit: pageSize}
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(zero, err)
+				return
+			}
+
+			items, paging, err := fetch(ctx, page)
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+
+			for _, item := range items {
+				if err := ctx.Err(); err != nil {
+					yield(zero, err)
+					return
+				}
+				if !yield(item, nil) {
+					return
+				}
+			}
+
+			if paging.After == "" {
+				return
+			}
+			page.After = paging.After
+		}
+	}
+}
+
+// Iterate over every vault account, fetching pageSize at a time.
+func (fb *Fireblocks) VaultAccounts(ctx context.Context, pageSize int) iter.Seq2[VaultAccount, error] {
+	return paginate(ctx, pageSize, func(ctx context.Context, page PageRequest) ([]VaultAccount, Paging, error) {
+		accounts, err := fb.ListVaultAccountsPaged(ctx, page)
+		if err != nil {
+			return nil, Paging{}, err
+		}
+		return accounts.Accounts, accounts.Paging, nil
+	})
+}
+
+// Iterate over every address of a vault account's asset, fetching pageSize
+// at a time.
+func (fb *Fireblocks) VaultAccountAssetAddresses(ctx context.Context, accountId, assetId string, pageSize int) iter.Seq2[Address, error] {
+	return paginate(ctx, pageSize, func(ctx context.Context, page PageRequest) ([]Address, Paging, error) {
+		addresses, err := fb.GetVaultAccountAssetAddresses(ctx, accountId, assetId, page)
+		if err != nil {
+			return nil, Paging{}, err
+		}
+		return addresses.Addresses, addresses.Paging, nil
+	})
+}
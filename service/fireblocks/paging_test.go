@@ -0,0 +1,107 @@
+package fireblocks_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/fionn/address-manager/fb_mock"
+	"github.com/fionn/address-manager/service/fireblocks"
+)
+
+func TestPaging(t *testing.T) {
+	fb := startMock(t, pagingMockHost, fb_mock.Config{})
+	ctx := context.Background()
+
+	var ids []string
+	for range 5 {
+		account, err := fb.CreateVaultAccount(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, account.ID)
+	}
+
+	var got []string
+	for account, err := range fb.VaultAccounts(ctx, 2) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, account.ID)
+	}
+	if !slices.Equal(got, ids) {
+		t.Errorf("expected vault accounts %v, got %v", ids, got)
+	}
+
+	// Page forward, then back.
+	first, err := fb.ListVaultAccountsPaged(ctx, fireblocks.PageRequest{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Paging.Before != "" || first.Paging.After == "" {
+		t.Errorf("unexpected cursors on the first page: %+v", first.Paging)
+	}
+	second, err := fb.ListVaultAccountsPaged(ctx, fireblocks.PageRequest{After: first.Paging.After, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Accounts[0].ID != ids[2] {
+		t.Errorf("expected the second page to start at %s, got %s", ids[2], second.Accounts[0].ID)
+	}
+	back, err := fb.ListVaultAccountsPaged(ctx, fireblocks.PageRequest{Before: second.Paging.Before, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Accounts[0].ID != ids[0] || len(back.Accounts) != 2 {
+		t.Errorf("expected to page back to the first page, got %+v", back.Accounts)
+	}
+
+	if _, err := fb.CreateVaultAccountAsset(ctx, ids[0], "BTC", ""); err != nil {
+		t.Fatal(err)
+	}
+	for range 4 {
+		if _, err := fb.CreateVaultAccountAssetAddress(ctx, ids[0], "BTC", fireblocks.CreateAddressRequest{}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var addresses int
+	for address, err := range fb.VaultAccountAssetAddresses(ctx, ids[0], "BTC", 2) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address.Bip44AddressIndex != addresses {
+			t.Errorf("expected address %d, got %d", addresses, address.Bip44AddressIndex)
+		}
+		addresses++
+	}
+	if addresses != 5 {
+		t.Errorf("expected 5 addresses, got %d", addresses)
+	}
+
+	// Errors end the iteration.
+	var errs []error
+	for _, err := range fb.VaultAccountAssetAddresses(ctx, "unknown", "BTC", 2) {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], fireblocks.ErrNotFound) {
+		t.Errorf("expected a single not found error, got %v", errs)
+	}
+
+	// So does cancellation.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var seen int
+	errs = nil
+	for _, err := range fb.VaultAccounts(cancelCtx, 2) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		seen++
+		cancel()
+	}
+	if seen != 1 || len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+		t.Errorf("expected to stop after 1 vault account with a cancellation error, got %d and %v", seen, errs)
+	}
+}
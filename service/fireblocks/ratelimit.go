@@ -0,0 +1,164 @@
+package fireblocks
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Fireblocks limits reads and writes separately, so we do too.
+type EndpointClass string
+
+const (
+	ClassRead  EndpointClass = "read"
+	ClassWrite EndpointClass = "write"
+)
+
+func classOf(method string) EndpointClass {
+	if method == http.MethodGet || method == http.MethodHead {
+		return ClassRead
+	}
+	return ClassWrite
+}
+
+// How many times a request is retried after a 429 before giving up and
+// returning it.
+const maxRateLimitRetries = 3
+
+// How long to back off after a 429 that doesn't say how long to wait.
+const defaultRetryAfter = time.Second
+
+var (
+	// Total time spent waiting on the rate limiter, by endpoint class.
+	RateLimitWait = expvar.NewMap("fireblocks_rate_limit_wait_seconds")
+	// 429 responses, by endpoint class.
+	RateLimited = expvar.NewMap("fireblocks_rate_limited_responses")
+)
+
+// TokenBucket is a token bucket rate limiter: it holds up to Burst tokens,
+// refilled at Rate per second, and each request takes one.
+type TokenBucket struct {
+	// Tokens per second. Zero means unlimited, though the bucket can still
+	// be paused.
+	Rate  float64
+	Burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	paused time.Time
+}
+
+// A bucket that starts full.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{Rate: rate, Burst: burst, tokens: float64(burst)}
+}
+
+// Top the bucket up for the time since we last did. Callers hold mu.
+func (b *TokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = min(float64(b.Burst), b.tokens+now.Sub(b.last).Seconds()*b.Rate)
+	}
+	b.last = now
+}
+
+// Take a token, returning how long to wait before it may be used. The bucket
+// goes into debt, so later callers queue up behind earlier ones.
+func (b *TokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var wait time.Duration
+	if b.Rate > 0 {
+		b.refill(now)
+		b.tokens--
+		if b.tokens < 0 {
+			wait = time.Duration(-b.tokens / b.Rate * float64(time.Second))
+		}
+	}
+	return max(wait, b.paused.Sub(now))
+}
+
+// Give back a token we didn't use.
+func (b *TokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Rate > 0 {
+		b.tokens = min(float64(b.Burst), b.tokens+1)
+	}
+}
+
+// Take a token if one is available now. Otherwise, report how long until
+// one will be.
+func (b *TokenBucket) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(b.paused) {
+		return false, b.paused.Sub(now)
+	}
+	if b.Rate <= 0 {
+		return true, 0
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / b.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Wait until a token is available and take it, returning how long we
+// waited.
+func (b *TokenBucket) Wait(ctx context.Context) (time.Duration, error) {
+	wait := b.reserve(time.Now())
+	if wait <= 0 {
+		if err := ctx.Err(); err != nil {
+			b.cancel()
+			return 0, err
+		}
+		return 0, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		b.cancel()
+		return wait, ctx.Err()
+	case <-timer.C:
+		return wait, nil
+	}
+}
+
+// Hand out no tokens until the given time, e.g. because the server told us
+// to back off.
+func (b *TokenBucket) Pause(until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until.After(b.paused) {
+		b.paused = until
+	}
+}
+
+// Parse a Retry-After header, which is either a number of seconds or an HTTP
+// date. Reports false if it's missing or invalid.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(0, date.Sub(now)), true
+	}
+	return 0, false
+}
+
+// Format a wait as a Retry-After header, rounding up to whole seconds.
+func FormatRetryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
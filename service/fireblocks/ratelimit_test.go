@@ -0,0 +1,140 @@
+package fireblocks_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fionn/address-manager/fb_mock"
+	"github.com/fionn/address-manager/service/fireblocks"
+)
+
+func expvarFloat(m *expvar.Map, key string) float64 {
+	if v, ok := m.Get(key).(*expvar.Float); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := fireblocks.NewTokenBucket(10, 2)
+	for range 2 {
+		if ok, _ := bucket.Allow(); !ok {
+			t.Fatal("expected a full bucket to allow its burst")
+		}
+	}
+	ok, wait := bucket.Allow()
+	if ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("expected an empty bucket to refuse for up to 100ms, got %t and %s", ok, wait)
+	}
+
+	waited, err := bucket.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited <= 0 {
+		t.Error("expected to wait for a token")
+	}
+
+	bucket = fireblocks.NewTokenBucket(0, 0)
+	bucket.Pause(time.Now().Add(time.Hour))
+	if ok, wait := bucket.Allow(); ok || wait < 59*time.Minute {
+		t.Errorf("expected a paused bucket to refuse for an hour, got %t and %s", ok, wait)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := bucket.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected waiting on a paused bucket to time out, got %v", err)
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer server.Close()
+
+	fb, err := fireblocks.NewFireblocksSession(server.URL, fireblocks.WithRateLimit(fireblocks.ClassWrite, 20, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitBefore := expvarFloat(fireblocks.RateLimitWait, string(fireblocks.ClassWrite))
+	start := time.Now()
+	for range 5 {
+		if _, err := fb.CreateVaultAccount(context.Background(), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One in the burst, then one every 50ms.
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("5 requests at 20/s took only %s", elapsed)
+	}
+	if waited := expvarFloat(fireblocks.RateLimitWait, string(fireblocks.ClassWrite)) - waitBefore; waited <= 0 {
+		t.Error("expected limiter wait time to be recorded")
+	}
+
+	// Reads aren't limited.
+	start = time.Now()
+	for range 5 {
+		if _, err := fb.GetVaultAccount(context.Background(), "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("unlimited reads took %s", elapsed)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	fb := startMock(t, rateLimitMockHost, fb_mock.Config{RateLimit: 1, RateLimitBurst: 1})
+	ctx := context.Background()
+
+	limitedBefore := expvarInt(fireblocks.RateLimited, string(fireblocks.ClassWrite))
+	if _, err := fb.CreateVaultAccount(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	// This gets a 429 with Retry-After: 1, which we wait out before
+	// retrying.
+	start := time.Now()
+	if _, err := fb.CreateVaultAccount(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("expected to back off for a second after a 429, only took %s", elapsed)
+	}
+	if limited := expvarInt(fireblocks.RateLimited, string(fireblocks.ClassWrite)) - limitedBefore; limited < 1 {
+		t.Error("expected the 429 to be counted")
+	}
+}
+
+func TestRetryPolicyHonoursRetryAfter(t *testing.T) {
+	policy := fireblocks.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	calls := 0
+	start := time.Now()
+	err := policy.Do(context.Background(), func(context.Context) error {
+		calls++
+		if calls == 1 {
+			return &fireblocks.Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 100 * time.Millisecond}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected to wait out Retry-After, only took %s", elapsed)
+	}
+}
@@ -0,0 +1,335 @@
+package fireblocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Returned when the circuit breaker is open and calls are being rejected.
+var ErrCircuitOpen = errors.New("fireblocks circuit breaker is open")
+
+// What an error says about Fireblocks. It may join the errors of several calls
+// made at once, e.g. creating a vault account's assets in parallel, so we look
+// at every one of them rather than whichever comes first.
+type outcome struct {
+	// The worst status Fireblocks responded with, if any call got a
+	// response: a 5xx, then a 429, then a 409, then any other 4xx.
+	status int
+	// Whether any call failed without a response, e.g. a network error.
+	unanswered bool
+	// Whether any call failed on our side, see LocalError.
+	local bool
+	// The longest Fireblocks asked us to wait.
+	retryAfter time.Duration
+}
+
+// How bad a status is, for picking the worst of several.
+func severity(status int) int {
+	switch {
+	case status >= 500:
+		return 3
+	case status == http.StatusTooManyRequests:
+		return 2
+	case status == http.StatusConflict:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func classify(err error) outcome {
+	var o outcome
+	var walk func(error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case nil:
+		case *Error:
+			if o.status == 0 || severity(e.StatusCode) > severity(o.status) {
+				o.status = e.StatusCode
+			}
+			o.retryAfter = max(o.retryAfter, e.RetryAfter)
+		case *LocalError:
+			o.local = true
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				walk(err)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		default:
+			o.unanswered = true
+		}
+	}
+	walk(err)
+	return o
+}
+
+// The worst status code Fireblocks responded with, if every call got a
+// response. It's all we classify responses by: whatever the body says, a 5xx
+// is worth retrying and a 4xx isn't.
+func statusCode(err error) (int, bool) {
+	o := classify(err)
+	return o.status, o.status != 0 && !o.unanswered
+}
+
+// Report whether an error is worth retrying. Network errors, 5xx and 429
+// responses are transient, as is a 409, which means the same request (by
+// idempotency key) is still in progress, e.g. after we timed out waiting for
+// it. Other 4xx responses mean the request itself is wrong, so retrying won't
+// help.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	// A request timing out is as transient as a network error. If it was the
+	// caller's deadline that passed, Do stops retrying anyway.
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+
+	if status, ok := statusCode(err); ok {
+		return status >= 500 || status == http.StatusTooManyRequests || status == http.StatusConflict
+	}
+
+	// The connection being dropped mid-request is as transient as it gets.
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// LocalError marks an error as ours rather than Fireblocks', e.g. failing to
+// write to our own database, so Do doesn't hold it against the circuit
+// breaker, however much it looks like Fireblocks being unreachable.
+type LocalError struct {
+	Err error
+}
+
+func (e *LocalError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LocalError) Unwrap() error {
+	return e.Err
+}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker stops calls to Fireblocks after Threshold consecutive
+// failures. Once Cooldown has elapsed it lets a single trial call through
+// (half-open); if that succeeds the breaker closes, otherwise it opens again.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+func (b *CircuitBreaker) state(now time.Time) BreakerState {
+	if b.failures < b.Threshold {
+		return BreakerClosed
+	}
+	if now.Sub(b.openedAt) < b.Cooldown {
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// Current state of the breaker, e.g. for health checks.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state(time.Now())
+}
+
+// Time until the breaker will next let a call through.
+func (b *CircuitBreaker) Remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state(time.Now()) != BreakerOpen {
+		return 0
+	}
+	return b.Cooldown - time.Since(b.openedAt)
+}
+
+// Return ErrCircuitOpen if a call shouldn't be made right now.
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state(time.Now()) {
+	case BreakerOpen:
+		return ErrCircuitOpen
+	case BreakerHalfOpen:
+		if b.trial {
+			return ErrCircuitOpen
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.Threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// Give up a trial call without counting it either way, e.g. because the
+// caller cancelled it, so that the next call can be the trial instead.
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// RetryPolicy retries transient failures with capped exponential backoff and
+// full jitter.
+type RetryPolicy struct {
+	// Zero means retry until the context is cancelled.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Optional, shared between everything calling Fireblocks.
+	Breaker *CircuitBreaker
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		BaseDelay: 100 * time.Millisecond,
+		MaxDelay:  30 * time.Second,
+		Breaker:   NewCircuitBreaker(5, 30*time.Second),
+	}
+}
+
+// Delay before the given retry (counting from zero), chosen uniformly at
+// random between zero and the capped exponential backoff.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := p.MaxDelay
+	if attempt < 62 {
+		if d := p.BaseDelay << attempt; d > 0 && d < p.MaxDelay {
+			backoff = d
+		}
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// Call f until it succeeds, returns a permanent error, the attempts run out
+// or the context is cancelled.
+func (p RetryPolicy) Do(ctx context.Context, f func(context.Context) error) error {
+	var err error
+	for attempt := 0; p.MaxAttempts == 0 || attempt < p.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := max(p.Backoff(attempt-1), classify(err).retryAfter)
+			if p.Breaker != nil {
+				delay = max(delay, p.Breaker.Remaining())
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return errors.Join(err, ctx.Err())
+			case <-timer.C:
+			}
+		}
+
+		if p.Breaker != nil {
+			if err = p.Breaker.Allow(); err != nil {
+				continue
+			}
+		}
+
+		err = f(ctx)
+		if err == nil {
+			if p.Breaker != nil {
+				p.Breaker.Success()
+			}
+			return nil
+		}
+
+		// We gave up rather than Fireblocks failing, so don't hold it
+		// against the breaker, but don't keep the trial call either.
+		if ctx.Err() != nil {
+			if p.Breaker != nil {
+				p.Breaker.Release()
+			}
+			return err
+		}
+
+		if p.Breaker != nil {
+			switch o := classify(err); {
+			case o.local:
+				// Our own failure says nothing about Fireblocks.
+				p.Breaker.Release()
+			case !o.unanswered && o.status != 0 && o.status < 500 && o.status != http.StatusTooManyRequests:
+				// A 4xx other than a 429 means Fireblocks answered, so
+				// as far as the breaker is concerned it's healthy.
+				p.Breaker.Success()
+			default:
+				p.Breaker.Failure()
+			}
+		}
+		if !IsRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
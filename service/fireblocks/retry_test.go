@@ -0,0 +1,219 @@
+package fireblocks_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fionn/address-manager/service/fireblocks"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{&fireblocks.Error{StatusCode: http.StatusInternalServerError}, true},
+		{&fireblocks.Error{StatusCode: http.StatusTooManyRequests}, true},
+		{&fireblocks.Error{StatusCode: http.StatusNotFound}, false},
+		{&fireblocks.Error{StatusCode: http.StatusConflict}, true},
+		{fmt.Errorf("wrapped: %w", &fireblocks.Error{StatusCode: http.StatusBadGateway}), true},
+		// Only the status counts, not what the body says.
+		{&fireblocks.Error{StatusCode: http.StatusServiceUnavailable, Code: 1006, Message: "Unknown asset"}, true},
+		{&fireblocks.Error{StatusCode: http.StatusBadRequest, Message: "Internal error, try again"}, false},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{context.Canceled, false},
+		{errors.New("something else"), false},
+		// Joined errors are as retryable as the worst of them, whichever
+		// order they're in.
+		{errors.Join(&fireblocks.Error{StatusCode: http.StatusBadRequest}, &fireblocks.Error{StatusCode: http.StatusServiceUnavailable}), true},
+		{errors.Join(&fireblocks.Error{StatusCode: http.StatusServiceUnavailable}, &fireblocks.Error{StatusCode: http.StatusBadRequest}), true},
+		{errors.Join(&fireblocks.Error{StatusCode: http.StatusBadRequest}, &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{errors.Join(&fireblocks.Error{StatusCode: http.StatusBadRequest}, &fireblocks.Error{StatusCode: http.StatusNotFound}), false},
+	}
+
+	for _, c := range cases {
+		if got := fireblocks.IsRetryable(c.err); got != c.retryable {
+			t.Errorf("IsRetryable(%v) = %t, expected %t", c.err, got, c.retryable)
+		}
+	}
+}
+
+func TestBackoffCapped(t *testing.T) {
+	policy := fireblocks.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	for attempt := range 100 {
+		if d := policy.Backoff(attempt); d < 0 || d > policy.MaxDelay {
+			t.Errorf("Backoff(%d) = %s, outside [0, %s]", attempt, d, policy.MaxDelay)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := fireblocks.RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	transient := &fireblocks.Error{StatusCode: http.StatusServiceUnavailable}
+	permanent := &fireblocks.Error{StatusCode: http.StatusBadRequest}
+
+	calls := 0
+	err := policy.Do(context.Background(), func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return transient
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected success after 3 calls, got %v after %d", err, calls)
+	}
+
+	calls = 0
+	err = policy.Do(context.Background(), func(context.Context) error {
+		calls++
+		return permanent
+	})
+	if !errors.Is(err, permanent) || calls != 1 {
+		t.Errorf("Expected permanent error after 1 call, got %v after %d", err, calls)
+	}
+
+	calls = 0
+	err = policy.Do(context.Background(), func(context.Context) error {
+		calls++
+		return transient
+	})
+	if !errors.Is(err, transient) || calls != policy.MaxAttempts {
+		t.Errorf("Expected transient error after %d calls, got %v after %d", policy.MaxAttempts, err, calls)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := fireblocks.NewCircuitBreaker(2, 50*time.Millisecond)
+
+	breaker.Failure()
+	if state := breaker.State(); state != fireblocks.BreakerClosed {
+		t.Fatalf("Breaker %s after one failure, expected closed", state)
+	}
+	breaker.Failure()
+	if state := breaker.State(); state != fireblocks.BreakerOpen {
+		t.Fatalf("Breaker %s after two failures, expected open", state)
+	}
+	if err := breaker.Allow(); !errors.Is(err, fireblocks.ErrCircuitOpen) {
+		t.Fatalf("Expected %s, got %v", fireblocks.ErrCircuitOpen, err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if state := breaker.State(); state != fireblocks.BreakerHalfOpen {
+		t.Fatalf("Breaker %s after cooldown, expected half-open", state)
+	}
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("Expected a trial call to be allowed, got %s", err)
+	}
+	if err := breaker.Allow(); !errors.Is(err, fireblocks.ErrCircuitOpen) {
+		t.Fatalf("Expected only one trial call, got %v", err)
+	}
+
+	breaker.Success()
+	if state := breaker.State(); state != fireblocks.BreakerClosed {
+		t.Errorf("Breaker %s after success, expected closed", state)
+	}
+}
+
+func TestRetryPolicyOpensBreaker(t *testing.T) {
+	breaker := fireblocks.NewCircuitBreaker(3, time.Hour)
+	policy := fireblocks.RetryPolicy{MaxAttempts: 10, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Breaker: breaker}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	err := policy.Do(ctx, func(context.Context) error {
+		calls++
+		return &fireblocks.Error{StatusCode: http.StatusBadGateway}
+	})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if calls != breaker.Threshold {
+		t.Errorf("Made %d calls, expected the breaker to stop them at %d", calls, breaker.Threshold)
+	}
+	if state := breaker.State(); state != fireblocks.BreakerOpen {
+		t.Errorf("Breaker %s, expected open", state)
+	}
+}
+
+func TestRetryPolicyCancelledTrialReleasesBreaker(t *testing.T) {
+	breaker := fireblocks.NewCircuitBreaker(1, 10*time.Millisecond)
+	policy := fireblocks.RetryPolicy{MaxAttempts: 1, Breaker: breaker}
+
+	breaker.Failure()
+	time.Sleep(20 * time.Millisecond)
+	if state := breaker.State(); state != fireblocks.BreakerHalfOpen {
+		t.Fatalf("Breaker %s after cooldown, expected half-open", state)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := policy.Do(ctx, func(ctx context.Context) error {
+		cancel()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected %s, got %v", context.Canceled, err)
+	}
+
+	if state := breaker.State(); state != fireblocks.BreakerHalfOpen {
+		t.Errorf("Breaker %s after a cancelled trial, expected half-open", state)
+	}
+	if err := breaker.Allow(); err != nil {
+		t.Errorf("Expected another trial call to be allowed, got %s", err)
+	}
+}
+
+func TestRetryPolicyIgnoresLocalErrors(t *testing.T) {
+	breaker := fireblocks.NewCircuitBreaker(1, time.Hour)
+	policy := fireblocks.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Breaker: breaker}
+
+	// Even if it looks like a network error, e.g. losing our database.
+	local := &fireblocks.LocalError{Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	calls := 0
+	err := policy.Do(context.Background(), func(context.Context) error {
+		calls++
+		return local
+	})
+	if !errors.Is(err, local) || calls != policy.MaxAttempts {
+		t.Errorf("Expected local error after %d calls, got %v after %d", policy.MaxAttempts, err, calls)
+	}
+	if state := breaker.State(); state != fireblocks.BreakerClosed {
+		t.Errorf("Breaker %s after local errors, expected closed", state)
+	}
+}
+
+func TestRetryPolicyJoinedErrors(t *testing.T) {
+	badRequest := &fireblocks.Error{StatusCode: http.StatusBadRequest}
+	unavailable := &fireblocks.Error{StatusCode: http.StatusServiceUnavailable}
+	local := &fireblocks.LocalError{Err: errors.New("database is locked")}
+
+	for _, c := range []struct {
+		name  string
+		err   error
+		state fireblocks.BreakerState
+	}{
+		// The worst of them counts against the breaker, whichever order
+		// they're in.
+		{"client error first", errors.Join(badRequest, unavailable), fireblocks.BreakerOpen},
+		{"server error first", errors.Join(unavailable, badRequest), fireblocks.BreakerOpen},
+		{"only client errors", errors.Join(badRequest, badRequest), fireblocks.BreakerClosed},
+		// And any of our own failures releases it.
+		{"local error", errors.Join(badRequest, fmt.Errorf("failed to journal: %w", local)), fireblocks.BreakerClosed},
+	} {
+		breaker := fireblocks.NewCircuitBreaker(1, time.Hour)
+		policy := fireblocks.RetryPolicy{MaxAttempts: 1, Breaker: breaker}
+		if err := policy.Do(context.Background(), func(context.Context) error { return c.err }); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if state := breaker.State(); state != c.state {
+			t.Errorf("%s: breaker %s, expected %s", c.name, state, c.state)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A slot in a named, database-backed lease. A lease has a fixed number of
+// slots, so at most that many holders can hold it at once.
+type LeaseSlot struct {
+	Name      string `gorm:"primarykey"`
+	Slot      int    `gorm:"primarykey;autoIncrement:false"`
+	Holder    string
+	ExpiresAt time.Time
+}
+
+// Lease coordinates work between replicas sharing a database. A holder must
+// renew it (by calling Acquire again) before TTL elapses, otherwise another
+// replica may take its slot.
+type Lease struct {
+	DB     *gorm.DB
+	Name   string
+	Holder string
+	Slots  int
+	TTL    time.Duration
+}
+
+// Ensure all slots for this lease exist, so that acquisition is a guarded
+// update rather than a racy insert.
+func (l *Lease) ensureSlots() error {
+	slots := make([]LeaseSlot, l.Slots)
+	for i := range slots {
+		slots[i] = LeaseSlot{Name: l.Name, Slot: i}
+	}
+	return l.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&slots).Error
+}
+
+// Acquire a slot in the lease, or renew the slot we already hold. Returns
+// false if all slots are held by other live holders.
+func (l *Lease) Acquire() (bool, error) {
+	if l.Slots < 1 {
+		return false, errors.New("lease must have at least one slot")
+	}
+	if err := l.ensureSlots(); err != nil {
+		return false, fmt.Errorf("failed to create lease slots: %s", err)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(l.TTL)
+
+	// Renew first, so we don't end up holding more than one slot.
+	result := l.DB.Model(&LeaseSlot{}).
+		Where("name = ? AND holder = ?", l.Name, l.Holder).
+		Update("expires_at", expiresAt)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	for slot := range l.Slots {
+		result := l.DB.Model(&LeaseSlot{}).
+			Where("name = ? AND slot = ? AND (holder = '' OR expires_at < ?)", l.Name, slot, now).
+			Updates(map[string]any{"holder": l.Holder, "expires_at": expiresAt})
+		if result.Error != nil {
+			return false, result.Error
+		}
+		if result.RowsAffected > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Release any slot we hold, so other replicas don't have to wait for it to
+// expire.
+func (l *Lease) Release() error {
+	return l.DB.Model(&LeaseSlot{}).
+		Where("name = ? AND holder = ?", l.Name, l.Holder).
+		Updates(map[string]any{"holder": "", "expires_at": time.Time{}}).Error
+}
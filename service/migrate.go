@@ -0,0 +1,416 @@
+package service
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+var (
+	ErrSchemaBehind   = errors.New("database schema is behind")
+	ErrSchemaAhead    = errors.New("database schema is ahead of this build")
+	ErrSchemaModified = errors.New("applied migration has been modified")
+)
+
+// Migration files are named e.g. 0001_initial.up.sql, with a matching
+// 0001_initial.down.sql to undo it.
+var migrationFilename = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// A change to the schema, and how to undo it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// If set, run in the same transaction before Up, for what SQL can't do
+	// on its own.
+	Prepare func(tx *gorm.DB, migration *Migration) error
+}
+
+// Prepare steps for migrations, by dialect and version.
+var migrationSteps = map[string]map[int]func(tx *gorm.DB, migration *Migration) error{
+	// PostgreSQL was only supported once we had migrations, so it has no
+	// AutoMigrated databases to adopt.
+	"sqlite": {1: addMissingColumns},
+}
+
+// Databases from before we had migrations were created by AutoMigrate, from
+// whatever the models were at the time, so their tables can lack columns the
+// initial migration has. Its CREATE TABLE IF NOT EXISTS leaves existing
+// tables as they are, so we add any missing columns first, to be sure its
+// indexes on them can be created. The columns are whatever the migration's
+// tables have when it's applied to an empty database.
+func addMissingColumns(tx *gorm.DB, migration *Migration) error {
+	scratch, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: tx.Logger})
+	if err != nil {
+		return err
+	}
+	scratchDB, err := scratch.DB()
+	if err != nil {
+		return err
+	}
+	defer scratchDB.Close()
+	// Every connection to :memory: is its own database.
+	scratchDB.SetMaxOpenConns(1)
+	if err := scratch.Exec(migration.Up).Error; err != nil {
+		return fmt.Errorf("failed to apply migration to an empty database: %w", err)
+	}
+
+	tables, err := scratch.Migrator().GetTables()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		// Like sqlite_sequence, which is SQLite's own.
+		if strings.HasPrefix(table, "sqlite_") || !tx.Migrator().HasTable(table) {
+			continue
+		}
+		var columns []struct {
+			Name string
+			Type string
+		}
+		if err := scratch.Raw("SELECT name, type FROM pragma_table_info(?)", table).Scan(&columns).Error; err != nil {
+			return err
+		}
+		for _, column := range columns {
+			if tx.Migrator().HasColumn(table, column.Name) {
+				continue
+			}
+			if err := tx.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", table, column.Name, column.Type)).Error; err != nil {
+				return fmt.Errorf("failed to add column %s.%s: %w", table, column.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Of the up migration, so we notice if one is edited after it's applied.
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// SchemaMigration records a migration that's been applied to the database.
+type SchemaMigration struct {
+	Version   int `gorm:"primarykey;autoIncrement:false"`
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// Load the migrations for a database dialect, e.g. sqlite, in order.
+func LoadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", dialect, err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFilename.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		contents, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(contents)
+		} else {
+			migration.Down = string(contents)
+		}
+	}
+
+	var migrations []Migration
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migration.Prepare = migrationSteps[dialect][migration.Version]
+		migrations = append(migrations, *migration)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+// Migrator applies and rolls back migrations, recording which have been
+// applied in the schema_migrations table.
+type Migrator struct {
+	DB         *gorm.DB
+	Migrations []Migration
+}
+
+// A migrator with this build's migrations for the database.
+func NewMigrator(db *gorm.DB) (*Migrator, error) {
+	migrations, err := LoadMigrations(db.Dialector.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Migrations: migrations}, nil
+}
+
+// Where a migration is at in the database.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// Zero if it hasn't been applied.
+	AppliedAt time.Time
+	// Applied, but not the migration we have, or one we don't have at all.
+	Modified bool
+	Unknown  bool
+}
+
+func (m *Migrator) applied() ([]SchemaMigration, error) {
+	timestamp := "datetime"
+	if m.DB.Dialector.Name() == "postgres" {
+		timestamp = "timestamptz"
+	}
+	if err := m.DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		checksum text NOT NULL,
+		applied_at ` + timestamp + ` NOT NULL
+	)`).Error; err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	var applied []SchemaMigration
+	if err := m.DB.Order("version").Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// Every migration we know about and every one that's been applied, in order.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range m.Migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		i := slices.IndexFunc(applied, func(a SchemaMigration) bool { return a.Version == migration.Version })
+		if i >= 0 {
+			status.AppliedAt = applied[i].AppliedAt
+			status.Modified = applied[i].Checksum != migration.Checksum()
+		}
+		statuses = append(statuses, status)
+	}
+	for _, a := range applied {
+		if !slices.ContainsFunc(m.Migrations, func(migration Migration) bool { return migration.Version == a.Version }) {
+			statuses = append(statuses, MigrationStatus{Version: a.Version, Name: a.Name, AppliedAt: a.AppliedAt, Unknown: true})
+		}
+	}
+	slices.SortFunc(statuses, func(a, b MigrationStatus) int { return a.Version - b.Version })
+	return statuses, nil
+}
+
+// Check the database has exactly our migrations applied, unmodified.
+func (m *Migrator) Check() error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	var pending []int
+	for _, status := range statuses {
+		switch {
+		case status.Unknown:
+			return fmt.Errorf("%w: migration %d_%s is applied", ErrSchemaAhead, status.Version, status.Name)
+		case status.Modified:
+			return fmt.Errorf("%w: %d_%s", ErrSchemaModified, status.Version, status.Name)
+		case status.AppliedAt.IsZero():
+			pending = append(pending, status.Version)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: migrations %v are pending", ErrSchemaBehind, pending)
+	}
+	return nil
+}
+
+// Apply every pending migration, in order, each in its own transaction.
+// Returns how many were applied.
+func (m *Migrator) Up() (int, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return 0, err
+	}
+	applied := make(map[int]bool)
+	for _, status := range statuses {
+		if status.Modified {
+			return 0, fmt.Errorf("%w: %d_%s", ErrSchemaModified, status.Version, status.Name)
+		}
+		applied[status.Version] = !status.AppliedAt.IsZero()
+	}
+
+	count := 0
+	for _, migration := range m.Migrations {
+		if applied[migration.Version] {
+			continue
+		}
+		err := m.DB.Transaction(func(tx *gorm.DB) error {
+			if migration.Prepare != nil {
+				if err := migration.Prepare(tx, &migration); err != nil {
+					return err
+				}
+			}
+			if err := tx.Exec(migration.Up).Error; err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				Checksum:  migration.Checksum(),
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return count, fmt.Errorf("failed to apply migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Roll back the last steps applied migrations, latest first, each in its own
+// transaction. Returns how many were rolled back.
+func (m *Migrator) Down(steps int) (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(applied) - 1; i >= 0 && count < steps; i-- {
+		version := applied[i].Version
+		j := slices.IndexFunc(m.Migrations, func(migration Migration) bool { return migration.Version == version })
+		if j < 0 {
+			return count, fmt.Errorf("%w: can't roll back migration %d_%s", ErrSchemaAhead, version, applied[i].Name)
+		}
+		migration := m.Migrations[j]
+		err := m.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(migration.Down).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, version).Error
+		})
+		if err != nil {
+			return count, fmt.Errorf("failed to roll back migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// The migrate subcommand: up applies pending migrations and migrates data,
+// down [n] rolls back the last n (default 1), and status lists them all.
+func RunMigrate(args []string) {
+	db, err := openDatabase()
+	if err != nil {
+		log.Fatalf("Failed to connect to the database: %s", err)
+	}
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %s", err)
+	}
+
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "up":
+		count, err := migrator.Up()
+		if err != nil {
+			log.Fatalf("Failed to migrate after applying %d migrations: %s", count, err)
+		}
+		log.Printf("Applied %d migrations", count)
+
+		// Data is migrated in batches that are safe while replicas are
+		// serving, rather than in a migration, and running up again picks
+		// up whatever older replicas wrote in the meantime.
+		catalog, err := catalogFromEnv()
+		if err != nil {
+			log.Fatalf("Failed to load asset catalog: %s", err)
+		}
+		if migrated, err := MigrateAddresses(db, catalog); err != nil {
+			log.Fatalf("Failed to migrate addresses: %s", err)
+		} else if migrated > 0 {
+			log.Printf("Migrated %d addresses to the address table", migrated)
+		}
+		if normalized, err := NormalizeAddresses(db); err != nil {
+			log.Fatalf("Failed to normalize addresses: %s", err)
+		} else if normalized > 0 {
+			log.Printf("Normalized %d addresses", normalized)
+		}
+		if migrated, err := MigrateVaultAccountIDs(db); err != nil {
+			log.Fatalf("Failed to migrate vault account IDs: %s", err)
+		} else if migrated > 0 {
+			log.Printf("Recorded vault accounts on %d wallets", migrated)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid number of migrations to roll back %q", args[1])
+			}
+		}
+		count, err := migrator.Down(steps)
+		if err != nil {
+			log.Fatalf("Failed to roll back after rolling back %d migrations: %s", count, err)
+		}
+		log.Printf("Rolled back %d migrations", count)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			log.Fatalf("Failed to get migration status: %s", err)
+		}
+		for _, status := range statuses {
+			state := "pending"
+			switch {
+			case status.Unknown:
+				state = "applied, unknown to this build"
+			case status.Modified:
+				state = "applied, modified since"
+			case !status.AppliedAt.IsZero():
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+	default:
+		log.Fatalf("Unknown migrate command %q, expected up, down [n] or status", command)
+	}
+}
@@ -0,0 +1,7 @@
+DROP TABLE addresses;
+DROP TABLE derivation_counters;
+DROP TABLE provisioned_assets;
+DROP TABLE provisionings;
+DROP TABLE lease_slots;
+DROP TABLE wallets;
+DROP TABLE users;
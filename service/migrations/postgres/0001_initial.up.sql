@@ -0,0 +1,93 @@
+-- Users' IDs are generated by the database, so a user is inserted before the
+-- wallet claimed for them can point at it.
+CREATE TABLE users (
+	id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz
+);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
+
+CREATE TABLE wallets (
+	id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	vault_account_id text,
+	address_btc text,
+	address_sol text,
+	derivation_index bigint,
+	user_id uuid,
+	CONSTRAINT fk_users_wallet FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX idx_wallets_user_id ON wallets (user_id);
+CREATE INDEX idx_wallets_vault_account_id ON wallets (vault_account_id);
+CREATE INDEX idx_wallets_deleted_at ON wallets (deleted_at);
+
+CREATE TABLE lease_slots (
+	name text,
+	slot bigint,
+	holder text,
+	expires_at timestamptz,
+	PRIMARY KEY (name, slot)
+);
+
+CREATE TABLE provisionings (
+	id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	vault_account_id text,
+	state text,
+	attempts bigint,
+	last_error text,
+	idempotency_key text
+);
+CREATE INDEX idx_provisionings_state ON provisionings (state);
+CREATE INDEX idx_provisionings_vault_account_id ON provisionings (vault_account_id);
+CREATE INDEX idx_provisionings_deleted_at ON provisionings (deleted_at);
+
+CREATE TABLE provisioned_assets (
+	id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	provisioning_id bigint,
+	asset_id text,
+	wallet_id text,
+	address text,
+	legacy_address text,
+	enterprise_address text,
+	tag text,
+	status text,
+	derivation_index bigint,
+	CONSTRAINT fk_provisionings_assets FOREIGN KEY (provisioning_id) REFERENCES provisionings (id)
+);
+CREATE UNIQUE INDEX idx_provisioning_asset ON provisioned_assets (provisioning_id, asset_id);
+CREATE INDEX idx_provisioned_assets_deleted_at ON provisioned_assets (deleted_at);
+
+CREATE TABLE derivation_counters (
+	extended_key text PRIMARY KEY,
+	next_index bigint
+);
+
+CREATE TABLE addresses (
+	id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	wallet_id bigint,
+	asset_id text,
+	address text,
+	legacy_address text,
+	enterprise_address text,
+	tag text,
+	format text,
+	status text,
+	vault_account_id text,
+	vault_wallet_id text,
+	CONSTRAINT fk_wallets_addresses FOREIGN KEY (wallet_id) REFERENCES wallets (id)
+);
+CREATE UNIQUE INDEX idx_wallet_asset ON addresses (wallet_id, asset_id);
+CREATE INDEX idx_addresses_deleted_at ON addresses (deleted_at);
+CREATE INDEX idx_addresses_address ON addresses (address);
@@ -0,0 +1,5 @@
+DROP TABLE address_ownerships;
+DROP INDEX idx_addresses_enterprise_address;
+DROP INDEX idx_addresses_legacy_address;
+DROP INDEX idx_addresses_normalized_address;
+ALTER TABLE addresses DROP COLUMN normalized_address;
@@ -0,0 +1,20 @@
+-- Addresses as their format normalizes them (lower case for bech32 and hex,
+-- as is otherwise), so they're found however they're written. We fill this
+-- in, since that's where the normalization rules live; migrate up does it for
+-- addresses stored before.
+ALTER TABLE addresses ADD COLUMN normalized_address text;
+CREATE INDEX idx_addresses_normalized_address ON addresses (normalized_address, tag);
+-- Other encodings of an address are looked up as they were given to us.
+CREATE INDEX idx_addresses_legacy_address ON addresses (legacy_address);
+CREATE INDEX idx_addresses_enterprise_address ON addresses (enterprise_address);
+
+-- The one wallet each address belongs to, with its tag, since assets like XRP
+-- share an address between wallets and tell them apart by tag. A wallet may
+-- use an address for several assets, e.g. ETH and its tokens.
+CREATE TABLE address_ownerships (
+	normalized_address text NOT NULL,
+	tag text NOT NULL,
+	wallet_id bigint NOT NULL,
+	PRIMARY KEY (normalized_address, tag),
+	CONSTRAINT fk_address_ownerships_wallet FOREIGN KEY (wallet_id) REFERENCES wallets (id)
+);
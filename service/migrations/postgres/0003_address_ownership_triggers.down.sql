@@ -0,0 +1,2 @@
+DROP TRIGGER claim_address_ownership ON addresses;
+DROP FUNCTION claim_address_ownership();
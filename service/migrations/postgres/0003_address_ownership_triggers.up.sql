@@ -0,0 +1,29 @@
+-- Claim each address for its wallet in the database itself, so an address
+-- (with its tag) only ever belongs to one wallet, not only when it's written
+-- through our models. The ownership's primary key is what enforces that;
+-- storing an address another wallet owns is aborted. The address must come
+-- normalized, since only we know how to normalize it.
+--
+-- After the row's written, so conflicting inserts that end up doing nothing
+-- don't claim anything. Concurrent claims of the same address wait on the
+-- ownership's primary key, so the check sees whichever committed.
+CREATE FUNCTION claim_address_ownership() RETURNS trigger AS $$
+BEGIN
+	IF NEW.normalized_address IS NULL OR NEW.normalized_address = '' OR NEW.tag IS NULL THEN
+		RAISE EXCEPTION 'address must be stored with its normalized form and tag: %', NEW.address USING ERRCODE = 'not_null_violation';
+	END IF;
+	INSERT INTO address_ownerships (normalized_address, tag, wallet_id)
+		VALUES (NEW.normalized_address, NEW.tag, NEW.wallet_id)
+		ON CONFLICT DO NOTHING;
+	IF EXISTS (
+		SELECT 1 FROM address_ownerships
+		WHERE normalized_address = NEW.normalized_address AND tag = NEW.tag AND wallet_id <> NEW.wallet_id
+	) THEN
+		RAISE EXCEPTION 'address belongs to another wallet: %', NEW.address USING ERRCODE = 'unique_violation';
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER claim_address_ownership AFTER INSERT OR UPDATE OF normalized_address, tag, wallet_id ON addresses
+	FOR EACH ROW EXECUTE FUNCTION claim_address_ownership();
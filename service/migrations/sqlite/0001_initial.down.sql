@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS `addresses`;
+DROP TABLE IF EXISTS `derivation_counters`;
+DROP TABLE IF EXISTS `provisioned_assets`;
+DROP TABLE IF EXISTS `provisionings`;
+DROP TABLE IF EXISTS `lease_slots`;
+DROP TABLE IF EXISTS `wallets`;
+DROP TABLE IF EXISTS `users`;
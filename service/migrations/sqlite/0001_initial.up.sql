@@ -0,0 +1,27 @@
+-- The schema as AutoMigrate left it, so databases it created are adopted
+-- as they are.
+CREATE TABLE IF NOT EXISTS `users` (`id` text,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,PRIMARY KEY (`id`));
+CREATE INDEX IF NOT EXISTS `idx_users_deleted_at` ON `users`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `wallets` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`vault_account_id` text,`address_btc` text,`address_sol` text,`derivation_index` integer,`user_id` text,CONSTRAINT `fk_users_wallet` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`));
+CREATE INDEX IF NOT EXISTS `idx_wallets_user_id` ON `wallets`(`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_wallets_vault_account_id` ON `wallets`(`vault_account_id`);
+CREATE INDEX IF NOT EXISTS `idx_wallets_deleted_at` ON `wallets`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `lease_slots` (`name` text,`slot` integer,`holder` text,`expires_at` datetime,PRIMARY KEY (`name`,`slot`));
+
+CREATE TABLE IF NOT EXISTS `provisionings` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`vault_account_id` text,`state` text,`attempts` integer,`last_error` text,`idempotency_key` text);
+CREATE INDEX IF NOT EXISTS `idx_provisionings_state` ON `provisionings`(`state`);
+CREATE INDEX IF NOT EXISTS `idx_provisionings_vault_account_id` ON `provisionings`(`vault_account_id`);
+CREATE INDEX IF NOT EXISTS `idx_provisionings_deleted_at` ON `provisionings`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `provisioned_assets` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`provisioning_id` integer,`asset_id` text,`wallet_id` text,`address` text,`legacy_address` text,`enterprise_address` text,`tag` text,`status` text,`derivation_index` integer,CONSTRAINT `fk_provisionings_assets` FOREIGN KEY (`provisioning_id`) REFERENCES `provisionings`(`id`));
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_provisioning_asset` ON `provisioned_assets`(`provisioning_id`,`asset_id`);
+CREATE INDEX IF NOT EXISTS `idx_provisioned_assets_deleted_at` ON `provisioned_assets`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `derivation_counters` (`extended_key` text,`next_index` integer,PRIMARY KEY (`extended_key`));
+
+CREATE TABLE IF NOT EXISTS `addresses` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`wallet_id` integer,`asset_id` text,`address` text,`legacy_address` text,`enterprise_address` text,`tag` text,`format` text,`status` text,`vault_account_id` text,`vault_wallet_id` text,CONSTRAINT `fk_wallets_addresses` FOREIGN KEY (`wallet_id`) REFERENCES `wallets`(`id`));
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_wallet_asset` ON `addresses`(`wallet_id`,`asset_id`);
+CREATE INDEX IF NOT EXISTS `idx_addresses_deleted_at` ON `addresses`(`deleted_at`);
+CREATE INDEX IF NOT EXISTS `idx_addresses_address` ON `addresses`(`address`);
@@ -0,0 +1,2 @@
+DROP TRIGGER `address_ownership_update`;
+DROP TRIGGER `address_ownership_insert`;
@@ -0,0 +1,26 @@
+-- Claim each address for its wallet in the database itself, so an address
+-- (with its tag) only ever belongs to one wallet, not only when it's written
+-- through our models. The ownership's primary key is what enforces that;
+-- storing an address another wallet owns is aborted. The address must come
+-- normalized, since only we know how to normalize it.
+CREATE TRIGGER `address_ownership_insert` AFTER INSERT ON `addresses`
+BEGIN
+	SELECT RAISE(ABORT, 'address must be stored with its normalized form and tag')
+		WHERE NEW.`normalized_address` IS NULL OR NEW.`normalized_address` = '' OR NEW.`tag` IS NULL;
+	INSERT OR IGNORE INTO `address_ownerships` (`normalized_address`, `tag`, `wallet_id`)
+		VALUES (NEW.`normalized_address`, NEW.`tag`, NEW.`wallet_id`);
+	SELECT RAISE(ABORT, 'address belongs to another wallet')
+		FROM `address_ownerships`
+		WHERE `normalized_address` = NEW.`normalized_address` AND `tag` = NEW.`tag` AND `wallet_id` != NEW.`wallet_id`;
+END;
+
+CREATE TRIGGER `address_ownership_update` AFTER UPDATE OF `normalized_address`, `tag`, `wallet_id` ON `addresses`
+BEGIN
+	SELECT RAISE(ABORT, 'address must be stored with its normalized form and tag')
+		WHERE NEW.`normalized_address` IS NULL OR NEW.`normalized_address` = '' OR NEW.`tag` IS NULL;
+	INSERT OR IGNORE INTO `address_ownerships` (`normalized_address`, `tag`, `wallet_id`)
+		VALUES (NEW.`normalized_address`, NEW.`tag`, NEW.`wallet_id`);
+	SELECT RAISE(ABORT, 'address belongs to another wallet')
+		FROM `address_ownerships`
+		WHERE `normalized_address` = NEW.`normalized_address` AND `tag` = NEW.`tag` AND `wallet_id` != NEW.`wallet_id`;
+END;
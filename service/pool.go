@@ -0,0 +1,384 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/fionn/address-manager/service/fireblocks"
+)
+
+// WalletPool keeps a stock of unassigned wallets in the database. When the
+// pool falls below LowWatermark it is refilled up to HighWatermark.
+//
+// Refills are triggered by Notify, which allocators call after taking a
+// wallet. Since other replicas allocate from the same pool without notifying
+// us, we also check every PollInterval.
+type WalletPool struct {
+	DB       *gorm.DB
+	Provider WalletProvider
+	// The assets each new wallet gets, those that are enabled and the
+	// provider supports.
+	Assets        Catalog
+	LowWatermark  int
+	HighWatermark int
+	PollInterval  time.Duration
+
+	// Maximum number of wallets provisioned concurrently.
+	Workers int
+	// Minimum time between starting to provision successive wallets, so a
+	// large refill doesn't burst past the provider's rate limits. Zero means
+	// no limit.
+	ProvisionInterval time.Duration
+	// How many times to try provisioning a wallet, across restarts, before
+	// abandoning it and retiring its account.
+	MaxProvisioningAttempts int
+	// How to retry failed provisioning. Its circuit breaker, if any, reflects
+	// whether the provider is reachable.
+	Retry fireblocks.RetryPolicy
+
+	// If non-nil, the watermarks are recomputed from recent demand before
+	// every refill, overriding LowWatermark and HighWatermark.
+	Sizer *PoolSizer
+
+	// If non-nil, we only refill while holding this lease, which bounds how
+	// many replicas refill concurrently. Each refilling replica counts the
+	// whole deficit and provisions all of it, so with more than one slot the
+	// pool can overshoot by up to the deficit (at most HighWatermark) per
+	// extra slot.
+	Lease *Lease
+
+	wake chan struct{}
+
+	mu     sync.Mutex
+	full   chan struct{}
+	added  chan struct{}
+	target PoolTarget
+}
+
+func NewWalletPool(db *gorm.DB, provider WalletProvider, lowWatermark, highWatermark int) *WalletPool {
+	return &WalletPool{
+		DB:                      db,
+		Provider:                provider,
+		Assets:                  DefaultCatalog,
+		LowWatermark:            lowWatermark,
+		HighWatermark:           highWatermark,
+		PollInterval:            5 * time.Second,
+		Workers:                 4,
+		Retry:                   fireblocks.DefaultRetryPolicy(),
+		MaxProvisioningAttempts: 3,
+		wake:                    make(chan struct{}, 1),
+		full:                    make(chan struct{}),
+		added:                   make(chan struct{}),
+	}
+}
+
+// Count the wallets in the pool, i.e. those not yet assigned to a user.
+func CountPoolWallets(db *gorm.DB) (int64, error) {
+	var count int64
+	if tx := db.Model(&Wallet{}).Where("user_id IS NULL").Count(&count); tx.Error != nil {
+		return 0, tx.Error
+	}
+	return count, nil
+}
+
+// Wake the refill loop, e.g. after a wallet has been taken from the pool.
+// This never blocks.
+func (p *WalletPool) Notify() {
+	p.mu.Lock()
+	select {
+	case <-p.full:
+		p.full = make(chan struct{})
+	default:
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+		// A wakeup is already pending, which will see this allocation too.
+	}
+}
+
+// Block until the pool has been filled to the high watermark, or the context
+// is cancelled. Mostly useful for tests.
+func (p *WalletPool) WaitFull(ctx context.Context) error {
+	p.mu.Lock()
+	full := p.full
+	p.mu.Unlock()
+
+	select {
+	case <-full:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Return a channel that's closed the next time this pool adds a wallet.
+func (p *WalletPool) Added() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.added
+}
+
+func (p *WalletPool) signalAdded() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	close(p.added)
+	p.added = make(chan struct{})
+}
+
+func (p *WalletPool) markFull() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.full:
+	default:
+		close(p.full)
+	}
+}
+
+// Sleep for d, returning false early if the context is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Acquire or renew the lease, if we have one.
+func (p *WalletPool) holdLease() bool {
+	if p.Lease == nil {
+		return true
+	}
+	held, err := p.Lease.Acquire()
+	if err != nil {
+		log.Printf("Failed to acquire lease %s: %s\n", p.Lease.Name, err)
+	}
+	return held
+}
+
+// Provision a wallet, retrying transient failures according to retry. Stale
+// provisionings left behind by earlier failures are resumed before we start
+// any new ones. Failures are recorded against the journal, unless ctx was
+// cancelled, in which case it's left pending to be resumed, or someone else
+// took it over. It's up to the caller to store the wallet, which closes the
+// journal.
+func (p *WalletPool) newWallet(ctx context.Context, retry fireblocks.RetryPolicy) (*Wallet, *Journal, error) {
+	provisioning, err := claimStaleProvisioning(p.DB)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look for stale provisionings: %w", err)
+	}
+	if provisioning != nil {
+		log.Printf("Resuming provisioning %d (vault account %q)\n", provisioning.ID, provisioning.VaultAccountID)
+	} else if provisioning, err = startProvisioning(p.DB); err != nil {
+		return nil, nil, fmt.Errorf("failed to start provisioning: %w", err)
+	}
+	journal := newJournal(p.DB, provisioning)
+
+	// Retries can back off for longer than it takes the provisioning to go
+	// stale, so keep it fresh throughout, and stop if we lose it anyway.
+	provisionCtx, cancel := context.WithCancelCause(ctx)
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		journal.heartbeat(provisionCtx, cancel)
+	}()
+
+	var wallet *Wallet
+	err = retry.Do(provisionCtx, func(ctx context.Context) error {
+		var err error
+		wallet, err = newWallet(ctx, p.Provider, p.Assets.Enabled(), journal)
+		if err != nil {
+			log.Printf("Failed to create wallet: %s\n", err)
+		}
+		return err
+	})
+	lost := context.Cause(provisionCtx)
+	cancel(nil)
+	<-heartbeatDone
+
+	if errors.Is(lost, ErrProvisioningTakenOver) {
+		return nil, nil, fmt.Errorf("giving up creating wallet: %w", lost)
+	}
+	if err != nil {
+		if ctx.Err() == nil && !errors.Is(err, ErrProvisioningTakenOver) {
+			if err := failProvisioning(ctx, p.Provider, journal, err, p.MaxProvisioningAttempts); err != nil {
+				log.Printf("Failed to record provisioning failure: %s\n", err)
+			}
+		}
+		return nil, nil, fmt.Errorf("giving up creating wallet: %w", err)
+	}
+	return wallet, journal, nil
+}
+
+// Add a provisioned wallet to the pool. If it can't be stored, e.g. because
+// another wallet has one of its addresses, that counts against the
+// provisioning's attempts like any other failure, so it isn't resumed
+// forever.
+func (p *WalletPool) store(ctx context.Context, wallet *Wallet, journal *Journal) error {
+	err := storeWallet(p.DB, wallet, journal)
+	if err != nil && !errors.Is(err, ErrProvisioningTakenOver) {
+		if err := failProvisioning(ctx, p.Provider, journal, err, p.MaxProvisioningAttempts); err != nil {
+			log.Printf("Failed to record provisioning failure: %s\n", err)
+		}
+	}
+	return err
+}
+
+// Provision a wallet and add it to the pool.
+func (p *WalletPool) provisionWallet(ctx context.Context) bool {
+	wallet, journal, err := p.newWallet(ctx, p.Retry)
+	if err != nil {
+		log.Printf("Failed to provision wallet: %s\n", err)
+		return false
+	}
+
+	if err := p.store(ctx, wallet, journal); err != nil {
+		log.Printf("Failed to store wallet: %s\n", err)
+		return false
+	}
+	p.signalAdded()
+	return true
+}
+
+// Provision n wallets with at most Workers in flight at once, returning how
+// many were added to the pool.
+func (p *WalletPool) provisionWallets(ctx context.Context, n int) int64 {
+	workers := make(chan struct{}, max(p.Workers, 1))
+	var created atomic.Int64
+	var wg sync.WaitGroup
+
+	var throttle <-chan time.Time
+	if p.ProvisionInterval > 0 {
+		ticker := time.NewTicker(p.ProvisionInterval)
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+provision:
+	for i := range n {
+		// Renew as we go, since a large refill can outlast the TTL.
+		if !p.holdLease() {
+			break
+		}
+
+		if throttle != nil && i > 0 {
+			select {
+			case <-throttle:
+			case <-ctx.Done():
+				break provision
+			}
+		}
+
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+			break provision
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+			if p.provisionWallet(ctx) {
+				created.Add(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+	return created.Load()
+}
+
+// The pool's current target size.
+func (p *WalletPool) Target() PoolTarget {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.target
+}
+
+// Work out the watermarks for this refill, resizing the pool if we have a
+// sizer.
+func (p *WalletPool) updateTarget() PoolTarget {
+	target := PoolTarget{LowWatermark: p.LowWatermark, HighWatermark: p.HighWatermark, ComputedAt: time.Now()}
+	if p.Sizer != nil {
+		if t, err := p.Sizer.Target(time.Now()); err != nil {
+			log.Printf("Failed to compute pool target, keeping the previous one: %s\n", err)
+			if previous := p.Target(); previous.HighWatermark > 0 {
+				target = previous
+			}
+		} else {
+			target = *t
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Sizer != nil && (target.LowWatermark != p.target.LowWatermark || target.HighWatermark != p.target.HighWatermark) {
+		log.Printf("Pool target is now %d-%d\n", target.LowWatermark, target.HighWatermark)
+	}
+	p.target = target
+	return target
+}
+
+// Top up the pool if it's below the low watermark.
+func (p *WalletPool) refill(ctx context.Context) {
+	if !p.holdLease() {
+		return
+	}
+
+	target := p.updateTarget()
+
+	count, err := CountPoolWallets(p.DB)
+	if err != nil {
+		log.Printf("Failed to count pool wallets: %s\n", err)
+		return
+	}
+
+	if count < int64(target.LowWatermark) {
+		count += p.provisionWallets(ctx, int(int64(target.HighWatermark)-count))
+	}
+
+	if count >= int64(target.HighWatermark) {
+		p.markFull()
+	}
+}
+
+// Keep the wallet pool populated until the context is cancelled. The pool is
+// persisted as unassigned wallet rows, so on startup we only top up the
+// difference between what's already stored and the high watermark.
+func (p *WalletPool) Run(ctx context.Context) {
+	if p.Lease != nil {
+		defer func() {
+			if err := p.Lease.Release(); err != nil {
+				log.Printf("Failed to release lease %s: %s\n", p.Lease.Name, err)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(p.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		p.refill(ctx)
+		select {
+		case <-ctx.Done():
+			log.Println("Cancelling wallet pool population")
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
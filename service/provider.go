@@ -0,0 +1,28 @@
+package service
+
+import (
+	"context"
+)
+
+// WalletProvider is what actually creates the wallets we hand out, e.g. a
+// custodian like Fireblocks.
+//
+// Providers work in terms of accounts, each holding one address per asset,
+// which become our wallets. Every step a provider takes is recorded in the
+// journal as it completes, so if provisioning fails part way through it can
+// be resumed, by provisioning again with the same journal, without leaking
+// what was already created.
+type WalletProvider interface {
+	// Provision an account holding the given assets, skipping whatever the
+	// journal says has been done already.
+	Provision(ctx context.Context, journal *Journal, assets []Asset) error
+	// Whether the provider can provision an asset at all. Wallets only get
+	// the assets their provider supports.
+	Supports(asset Asset) bool
+	// Look up the addresses the provider has for each of an account's
+	// assets, by asset ID. Assets the account doesn't have are missing from
+	// the result.
+	Lookup(ctx context.Context, accountId string, assets []Asset) (map[string][]string, error)
+	// Retire an account we've given up on, so it isn't used or shown.
+	Retire(ctx context.Context, accountId string) error
+}
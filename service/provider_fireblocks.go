@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"sync"
+
+	"github.com/fionn/address-manager/service/fireblocks"
+)
+
+// FireblocksProvider provisions wallets as Fireblocks vault accounts, with a
+// vault wallet per asset.
+type FireblocksProvider struct {
+	Fireblocks *fireblocks.Fireblocks
+	// Number of addresses to fetch per request when looking up an account.
+	PageSize int
+}
+
+// Create an asset in the journal's vault account and journal it.
+func (p *FireblocksProvider) createAsset(ctx context.Context, journal *Journal, asset Asset) error {
+	accountId := journal.AccountID()
+	fbVaultWallet, err := p.Fireblocks.CreateVaultAccountAsset(ctx, accountId, asset.FireblocksID, journal.StepKey(asset.ID))
+	if err != nil {
+		return fmt.Errorf("failed to create %s asset for account %s: %w", asset.ID, accountId, err)
+	}
+	if fbVaultWallet.Address == "" {
+		return fmt.Errorf("created %s asset for account %s has no address", asset.ID, accountId)
+	}
+
+	provisioned := ProvisionedAsset{
+		AssetID:           asset.ID,
+		WalletID:          fbVaultWallet.ID,
+		Address:           fbVaultWallet.Address,
+		LegacyAddress:     fbVaultWallet.LegacyAddress,
+		EnterpriseAddress: fbVaultWallet.EnterpriseAddress,
+		Tag:               fbVaultWallet.Tag,
+		Status:            fbVaultWallet.Status,
+	}
+	if err := journal.AddAsset(&provisioned); err != nil {
+		return fmt.Errorf("failed to journal %s asset for account %s: %w", asset.ID, accountId, err)
+	}
+	return nil
+}
+
+// Fireblocks has everything, as long as we know what it calls it.
+func (p *FireblocksProvider) Supports(asset Asset) bool {
+	return asset.FireblocksID != ""
+}
+
+func (p *FireblocksProvider) Provision(ctx context.Context, journal *Journal, assets []Asset) error {
+	if journal.AccountID() == "" {
+		fbVaultAccount, err := p.Fireblocks.CreateVaultAccount(ctx, journal.StepKey("vault_account"))
+		if err != nil {
+			return fmt.Errorf("failed to create vault account: %w", err)
+		}
+		if err := journal.SetAccountID(fbVaultAccount.ID); err != nil {
+			return fmt.Errorf("failed to journal vault account %s: %w", fbVaultAccount.ID, err)
+		}
+	}
+
+	// Creating the vault account gives us an Ethereum wallet by default, but
+	// we want other assets so we have to create them separately. They're
+	// independent once the vault account exists, so create them in
+	// parallel.
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for _, asset := range journal.Missing(assets) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.createAsset(ctx, journal, asset); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// Every vault account, other than the hidden ones, which are those we've
+// retired. Each page lists its vault accounts' assets, so we only fetch their
+// addresses, rather than looking each vault account up again.
+func (p *FireblocksProvider) Accounts(ctx context.Context, assets []Asset, pageSize int) iter.Seq2[ListedAccount, error] {
+	return func(yield func(ListedAccount, error) bool) {
+		for account, err := range p.Fireblocks.VaultAccounts(ctx, pageSize) {
+			if err != nil {
+				yield(ListedAccount{}, err)
+				return
+			}
+			if account.HiddenOnUI {
+				continue
+			}
+			addresses, err := p.vaultAddresses(ctx, &account, assets)
+			if err != nil {
+				yield(ListedAccount{}, err)
+				return
+			}
+			if !yield(ListedAccount{ID: account.ID, Addresses: addresses}, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (p *FireblocksProvider) Lookup(ctx context.Context, accountId string, assets []Asset) (map[string][]string, error) {
+	account, err := p.Fireblocks.GetVaultAccount(ctx, accountId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vault account %s: %w", accountId, err)
+	}
+	return p.vaultAddresses(ctx, account, assets)
+}
+
+// Fetch the addresses of each of the given assets in a vault account, by our
+// asset ID.
+func (p *FireblocksProvider) vaultAddresses(ctx context.Context, account *fireblocks.VaultAccount, assets []Asset) (map[string][]string, error) {
+	addresses := make(map[string][]string)
+	for _, vaultAsset := range account.Assets {
+		i := slices.IndexFunc(assets, func(asset Asset) bool { return asset.FireblocksID == vaultAsset.ID })
+		if i < 0 {
+			continue
+		}
+		assetId := assets[i].ID
+		addresses[assetId] = []string{}
+		for address, err := range p.Fireblocks.VaultAccountAssetAddresses(ctx, account.ID, vaultAsset.ID, p.PageSize) {
+			if err != nil {
+				return nil, fmt.Errorf("failed to get %s addresses for account %s: %w", assetId, account.ID, err)
+			}
+			addresses[assetId] = append(addresses[assetId], address.Address)
+		}
+	}
+	return addresses, nil
+}
+
+// Hide the vault account, so it doesn't clutter the workspace.
+func (p *FireblocksProvider) Retire(ctx context.Context, accountId string) error {
+	if err := p.Fireblocks.HideVaultAccount(ctx, accountId); err != nil {
+		return fmt.Errorf("failed to hide vault account %s: %w", accountId, err)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SLIP-0132 versions for extended public keys whose addresses are native
+// SegWit. They're the same keys as xpub and tpub, just labelled differently.
+var (
+	zpubVersion = []byte{0x04, 0xb2, 0x47, 0x46}
+	vpubVersion = []byte{0x04, 0x5f, 0x1c, 0xf6}
+)
+
+// The networks an HD provider can derive addresses for, by name.
+var hdNetworks = map[string]*chaincfg.Params{
+	"mainnet": &chaincfg.MainNetParams,
+	"testnet": &chaincfg.TestNet3Params,
+	"regtest": &chaincfg.RegressionNetParams,
+}
+
+var ErrIndexesExhausted = errors.New("no unhardened derivation indexes left")
+
+// DerivationCounter is the next derivation index to hand out for an extended
+// key. Indexes are only ever handed out once, even if provisioning the wallet
+// fails, so an address is never given to two users.
+type DerivationCounter struct {
+	ExtendedKey string `gorm:"primarykey"`
+	NextIndex   uint32
+}
+
+// HDProvider derives Bitcoin wallets from an account-level extended public
+// key (BIP32), without calling out to anyone. Each wallet gets the receiving
+// address at the next index, i.e. m/84'/coin'/account'/0/index for a BIP84
+// key.
+type HDProvider struct {
+	DB *gorm.DB
+	// Neutered, and with the network's standard xpub or tpub version so
+	// it's stored the same however it was configured.
+	Key     *hdkeychain.ExtendedKey
+	Network *chaincfg.Params
+	// Derive BIP86 Taproot addresses rather than BIP84 native SegWit ones,
+	// in which case Key should be a BIP86 account key.
+	Taproot bool
+}
+
+// Parse an xpub or zpub (tpub or vpub off mainnet) for an HD provider on the
+// named network. Private keys are rejected, we have no use for them.
+func NewHDProvider(db *gorm.DB, extendedKey string, network string, taproot bool) (*HDProvider, error) {
+	params, ok := hdNetworks[network]
+	if !ok {
+		return nil, fmt.Errorf("unknown network %q", network)
+	}
+
+	key, err := hdkeychain.NewKeyFromString(extendedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse extended key: %w", err)
+	}
+	if key.IsPrivate() {
+		return nil, errors.New("extended key is private, expected a public key")
+	}
+
+	segwitVersion := zpubVersion
+	if params != &chaincfg.MainNetParams {
+		segwitVersion = vpubVersion
+	}
+	segwit := bytes.Equal(key.Version(), segwitVersion)
+	if !key.IsForNet(params) && !segwit {
+		return nil, fmt.Errorf("extended key isn't for %s", network)
+	}
+	// A zpub or vpub is a BIP84 key, whose Taproot addresses the wallet it
+	// came from won't be looking at.
+	if segwit && taproot {
+		return nil, errors.New("extended key is for native SegWit, not Taproot")
+	}
+	key, err = key.CloneWithVersion(params.HDPublicKeyID[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalise extended key: %w", err)
+	}
+
+	return &HDProvider{DB: db, Key: key, Network: params, Taproot: taproot}, nil
+}
+
+// Only Bitcoin, since that's what the key derives addresses for.
+func (p *HDProvider) Supports(asset Asset) bool {
+	return asset.Chain == "bitcoin"
+}
+
+// Check we're asked for at most one asset's addresses. Every asset we
+// support would get the same address at an index, so two of them would share
+// it.
+func (p *HDProvider) CheckAssets(assets []Asset) error {
+	var supported []string
+	for _, asset := range assets {
+		if p.Supports(asset) {
+			supported = append(supported, asset.ID)
+		}
+	}
+	if len(supported) > 1 {
+		return fmt.Errorf("can only derive addresses for one asset, got %v", supported)
+	}
+	return nil
+}
+
+// Take the next derivation index for our key.
+func (p *HDProvider) nextIndex(ctx context.Context) (uint32, error) {
+	db := p.DB.WithContext(ctx)
+	counter := DerivationCounter{ExtendedKey: p.Key.String()}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&counter).Error; err != nil {
+		return 0, err
+	}
+
+	// Guard on the index we read, like claiming a wallet, and try again if
+	// another worker took it first.
+	for {
+		if err := db.Take(&counter, "extended_key = ?", counter.ExtendedKey).Error; err != nil {
+			return 0, err
+		}
+		if counter.NextIndex >= hdkeychain.HardenedKeyStart {
+			return 0, ErrIndexesExhausted
+		}
+		result := db.Model(&DerivationCounter{}).
+			Where("extended_key = ? AND next_index = ?", counter.ExtendedKey, counter.NextIndex).
+			Update("next_index", counter.NextIndex+1)
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		if result.RowsAffected == 1 {
+			return counter.NextIndex, nil
+		}
+	}
+}
+
+// The receiving address at an index.
+func (p *HDProvider) derive(index uint32) (string, error) {
+	external, err := p.Key.Derive(0)
+	if err != nil {
+		return "", err
+	}
+	child, err := external.Derive(index)
+	if err != nil {
+		return "", err
+	}
+	pubKey, err := child.ECPubKey()
+	if err != nil {
+		return "", err
+	}
+
+	var address btcutil.Address
+	if p.Taproot {
+		outputKey := txscript.ComputeTaprootKeyNoScript(pubKey)
+		address, err = btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), p.Network)
+	} else {
+		address, err = btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), p.Network)
+	}
+	if err != nil {
+		return "", err
+	}
+	return address.EncodeAddress(), nil
+}
+
+// The account ID is the derivation index, so resuming a provisioning derives
+// the same address rather than taking a new index.
+func (p *HDProvider) Provision(ctx context.Context, journal *Journal, assets []Asset) error {
+	if err := p.CheckAssets(assets); err != nil {
+		return err
+	}
+	accountId := journal.AccountID()
+	if accountId == "" {
+		index, err := p.nextIndex(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to take a derivation index: %w", localError(err))
+		}
+		accountId = strconv.FormatUint(uint64(index), 10)
+		if err := journal.SetAccountID(accountId); err != nil {
+			return fmt.Errorf("failed to journal derivation index %s: %w", accountId, err)
+		}
+	}
+	index, err := strconv.ParseUint(accountId, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid derivation index %s: %w", accountId, err)
+	}
+
+	for _, asset := range journal.Missing(assets) {
+		if !p.Supports(asset) {
+			return fmt.Errorf("can't derive %s addresses", asset.ID)
+		}
+		address, err := p.derive(uint32(index))
+		if err != nil {
+			return fmt.Errorf("failed to derive address %d: %w", index, err)
+		}
+		derivationIndex := uint32(index)
+		provisioned := ProvisionedAsset{AssetID: asset.ID, Address: address, DerivationIndex: &derivationIndex}
+		if err := journal.AddAsset(&provisioned); err != nil {
+			return fmt.Errorf("failed to journal address %d: %w", index, err)
+		}
+	}
+	return nil
+}
+
+func (p *HDProvider) Lookup(ctx context.Context, accountId string, assets []Asset) (map[string][]string, error) {
+	if err := p.CheckAssets(assets); err != nil {
+		return nil, err
+	}
+	index, err := strconv.ParseUint(accountId, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid derivation index %s: %w", accountId, err)
+	}
+	addresses := make(map[string][]string)
+	for _, asset := range assets {
+		if !p.Supports(asset) {
+			continue
+		}
+		address, err := p.derive(uint32(index))
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive address %d: %w", index, err)
+		}
+		addresses[asset.ID] = []string{address}
+	}
+	return addresses, nil
+}
+
+// There's nothing to clean up: the index is never handed out again, and
+// nobody was given the address.
+func (p *HDProvider) Retire(ctx context.Context, accountId string) error {
+	return nil
+}
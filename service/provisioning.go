@@ -0,0 +1,367 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/fionn/address-manager/service/fireblocks"
+)
+
+// How long a pending provisioning must go untouched before another worker may
+// assume whoever was working on it is gone, and resume it.
+const provisioningStaleAfter = time.Minute
+
+// How often we touch a provisioning we're working on, so it never looks stale
+// while we're still at it.
+const provisioningHeartbeat = provisioningStaleAfter / 4
+
+// Returned when someone else took over a provisioning we were working on,
+// because it looked stale, or it's no longer pending.
+var ErrProvisioningTakenOver = errors.New("provisioning was taken over")
+
+// Mark an error as ours, e.g. from our database, rather than the provider's,
+// so it doesn't count against the provider's circuit breaker.
+func localError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fireblocks.LocalError{Err: err}
+}
+
+// The time to stamp a provisioning with, at the precision every database we
+// support stores, so we can later compare it with what was stored.
+func provisioningTime() time.Time {
+	return time.Now().Truncate(time.Microsecond)
+}
+
+type ProvisioningState string
+
+const (
+	ProvisioningPending   ProvisioningState = "pending"
+	ProvisioningComplete  ProvisioningState = "complete"
+	ProvisioningAbandoned ProvisioningState = "abandoned"
+)
+
+// Provisioning journals the creation of a wallet by a WalletProvider, one
+// step at a time, so if we fail part way through we can resume with only the
+// missing steps rather than leaking what was already created.
+type Provisioning struct {
+	gorm.Model
+	// The provider's ID for the wallet's account, e.g. a Fireblocks vault
+	// account.
+	VaultAccountID string            `gorm:"index"`
+	State          ProvisioningState `gorm:"index"`
+	Attempts       int
+	LastError      string
+	// Each step's idempotency key is derived from this, so retrying a step
+	// whose response we lost (even after a restart) doesn't create a
+	// duplicate.
+	IdempotencyKey string
+	Assets         []ProvisionedAsset
+}
+
+func (p *Provisioning) BeforeCreate(tx *gorm.DB) error {
+	if p.IdempotencyKey == "" {
+		p.IdempotencyKey = uuid.NewString()
+	}
+	return nil
+}
+
+// The idempotency key for a step of the provisioning.
+func (p *Provisioning) stepKey(step string) string {
+	return uuid.NewSHA1(uuid.MustParse(p.IdempotencyKey), []byte(step)).String()
+}
+
+// An asset created in a provisioning's vault account.
+type ProvisionedAsset struct {
+	gorm.Model
+	ProvisioningID    uint   `gorm:"uniqueIndex:idx_provisioning_asset"`
+	AssetID           string `gorm:"uniqueIndex:idx_provisioning_asset"`
+	WalletID          string
+	Address           string
+	LegacyAddress     string
+	EnterpriseAddress string
+	Tag               string
+	Status            string
+	// Set if the address was derived from an extended key.
+	DerivationIndex *uint32
+}
+
+// Start journaling a new wallet.
+func startProvisioning(db *gorm.DB) (*Provisioning, error) {
+	now := provisioningTime()
+	journal := Provisioning{Model: gorm.Model{CreatedAt: now, UpdatedAt: now}, State: ProvisioningPending, Attempts: 1}
+	if tx := db.Create(&journal); tx.Error != nil {
+		return nil, tx.Error
+	}
+	return &journal, nil
+}
+
+// Take over a pending provisioning that nobody has touched in a while,
+// e.g. because the process working on it crashed. Returns nil if there isn't
+// one.
+func claimStaleProvisioning(db *gorm.DB) (*Provisioning, error) {
+	// Find rather than Take, since not finding one is the common case and
+	// isn't an error.
+	var stale []Provisioning
+	err := db.Where("state = ? AND updated_at < ?", ProvisioningPending, time.Now().Add(-provisioningStaleAfter)).
+		Order("id").Limit(1).Find(&stale).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(stale) == 0 {
+		return nil, nil
+	}
+	journal := stale[0]
+
+	// Guard on updated_at so if another worker got there first we back off.
+	err = (&Journal{db: db, provisioning: &journal}).update(db, map[string]any{"attempts": gorm.Expr("attempts + 1")})
+	if errors.Is(err, ErrProvisioningTakenOver) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := db.Preload("Assets").Take(&journal, journal.ID).Error; err != nil {
+		return nil, err
+	}
+	return &journal, nil
+}
+
+// Record that a provisioning attempt failed. After maxAttempts we give up and
+// retire the account, if we got as far as creating one.
+func failProvisioning(ctx context.Context, provider WalletProvider, journal *Journal, cause error, maxAttempts int) error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	provisioning := journal.provisioning
+
+	updates := map[string]any{"last_error": cause.Error()}
+	if provisioning.Attempts >= maxAttempts {
+		if provisioning.VaultAccountID != "" {
+			if err := provider.Retire(ctx, provisioning.VaultAccountID); err != nil {
+				return err
+			}
+		}
+		updates["state"] = ProvisioningAbandoned
+	}
+	return journal.update(journal.db, updates)
+}
+
+// Journal is what a WalletProvider sees of a provisioning, to find out what's
+// already been done and record each step as it completes. It's safe for
+// concurrent use.
+type Journal struct {
+	db *gorm.DB
+
+	mu           sync.Mutex
+	provisioning *Provisioning
+}
+
+func newJournal(db *gorm.DB, provisioning *Provisioning) *Journal {
+	return &Journal{db: db, provisioning: provisioning}
+}
+
+// Update the provisioning, provided it's still pending and nobody has touched
+// it since we last did, failing with ErrProvisioningTakenOver otherwise. Every
+// update bumps updated_at, which is both what keeps the provisioning from
+// going stale and how we tell someone else has taken it over. The caller must
+// hold j.mu.
+func (j *Journal) update(db *gorm.DB, updates map[string]any) error {
+	now := provisioningTime()
+	updates["updated_at"] = now
+	result := db.Model(&Provisioning{}).
+		Where("id = ? AND state = ? AND updated_at = ?", j.provisioning.ID, ProvisioningPending, j.provisioning.UpdatedAt).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrProvisioningTakenOver
+	}
+	j.provisioning.UpdatedAt = now
+	return nil
+}
+
+// Touch the provisioning every provisioningHeartbeat until ctx is done, so
+// nobody takes it over while we're working on it, even while we're backing
+// off between attempts. If someone takes it over anyway, we call lost.
+func (j *Journal) heartbeat(ctx context.Context, lost context.CancelCauseFunc) {
+	ticker := time.NewTicker(provisioningHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		j.mu.Lock()
+		err := j.update(j.db, map[string]any{})
+		j.mu.Unlock()
+		if errors.Is(err, ErrProvisioningTakenOver) {
+			lost(err)
+			return
+		} else if err != nil {
+			log.Printf("Failed to touch provisioning %d: %s\n", j.provisioning.ID, err)
+		}
+	}
+}
+
+// The provider's ID for the account being provisioned, or empty if it hasn't
+// been created yet.
+func (j *Journal) AccountID() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.provisioning.VaultAccountID
+}
+
+// Record that the account has been created.
+func (j *Journal) SetAccountID(accountId string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.update(j.db, map[string]any{"vault_account_id": accountId}); err != nil {
+		return localError(err)
+	}
+	j.provisioning.VaultAccountID = accountId
+	return nil
+}
+
+// Which of the given assets haven't been created yet.
+func (j *Journal) Missing(assets []Asset) []Asset {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var missing []Asset
+	for _, asset := range assets {
+		if !slices.ContainsFunc(j.provisioning.Assets, func(provisioned ProvisionedAsset) bool { return provisioned.AssetID == asset.ID }) {
+			missing = append(missing, asset)
+		}
+	}
+	return missing
+}
+
+// Record that an asset has been created.
+func (j *Journal) AddAsset(asset *ProvisionedAsset) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	asset.ProvisioningID = j.provisioning.ID
+	if err := j.db.Create(asset).Error; err != nil {
+		return localError(err)
+	}
+	j.provisioning.Assets = append(j.provisioning.Assets, *asset)
+	return nil
+}
+
+// Give journals from before we had idempotency keys one.
+func (j *Journal) ensureIdempotencyKey() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.provisioning.IdempotencyKey != "" {
+		return nil
+	}
+	key := uuid.NewString()
+	if err := j.update(j.db, map[string]any{"idempotency_key": key}); err != nil {
+		return localError(err)
+	}
+	j.provisioning.IdempotencyKey = key
+	return nil
+}
+
+// The idempotency key for a step, e.g. creating the account or one of its
+// assets, so a provider can safely retry a step whose outcome it didn't
+// hear about.
+func (j *Journal) StepKey(step string) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.provisioning.stepKey(step)
+}
+
+// Create a wallet with whichever of the given assets the provider supports,
+// resuming from wherever the journal got to.
+func newWallet(ctx context.Context, provider WalletProvider, assets []Asset, journal *Journal) (*Wallet, error) {
+	if err := journal.ensureIdempotencyKey(); err != nil {
+		return nil, fmt.Errorf("failed to journal idempotency key: %w", err)
+	}
+
+	assets = slices.DeleteFunc(slices.Clone(assets), func(asset Asset) bool {
+		return !provider.Supports(asset)
+	})
+	if err := provider.Provision(ctx, journal, assets); err != nil {
+		return nil, err
+	}
+	provisioning := journal.provisioning
+	if missing := journal.Missing(assets); len(missing) > 0 {
+		return nil, fmt.Errorf("provisioned account %s is missing %v", provisioning.VaultAccountID, missing)
+	}
+
+	// In catalog order, leaving out any assets the journal has that have
+	// since been disabled.
+	wallet := Wallet{VaultAccountID: provisioning.VaultAccountID}
+	for _, asset := range assets {
+		i := slices.IndexFunc(provisioning.Assets, func(provisioned ProvisionedAsset) bool { return provisioned.AssetID == asset.ID })
+		provisioned := provisioning.Assets[i]
+		if asset.NeedsTag && provisioned.Tag == "" {
+			return nil, fmt.Errorf("provisioned %s address for account %s has no tag", asset.ID, provisioning.VaultAccountID)
+		}
+		wallet.Addresses = append(wallet.Addresses, Address{
+			AssetID:           asset.ID,
+			Address:           provisioned.Address,
+			LegacyAddress:     provisioned.LegacyAddress,
+			EnterpriseAddress: provisioned.EnterpriseAddress,
+			Tag:               provisioned.Tag,
+			Format:            asset.AddressFormat,
+			Status:            provisioned.Status,
+			VaultAccountID:    provisioning.VaultAccountID,
+			VaultWalletID:     provisioned.WalletID,
+		})
+
+		switch provisioned.AssetID {
+		case "BTC":
+			wallet.AddressBTC = provisioned.Address
+			wallet.DerivationIndex = provisioned.DerivationIndex
+		case "SOL":
+			wallet.AddressSOL = provisioned.Address
+		}
+	}
+	return &wallet, nil
+}
+
+// Store a freshly provisioned wallet and close its journal, atomically, so a
+// wallet is never provisioned twice. If someone else has taken over the
+// provisioning, it's theirs to store, so we fail with
+// ErrProvisioningTakenOver and store nothing.
+func storeWallet(db *gorm.DB, wallet *Wallet, journal *Journal) error {
+	return storeWalletWith(db, wallet, journal, nil)
+}
+
+// Store a wallet as storeWallet does, in the same transaction as whatever
+// before does first, e.g. creating the user it's for. The journal is only
+// closed if all of it commits.
+func storeWalletWith(db *gorm.DB, wallet *Wallet, journal *Journal, before func(tx *gorm.DB) error) error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	updatedAt := journal.provisioning.UpdatedAt
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if before != nil {
+			if err := before(tx); err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(wallet).Error; err != nil {
+			return err
+		}
+		return journal.update(tx, map[string]any{"state": ProvisioningComplete})
+	})
+	if err != nil {
+		// Nothing we did was committed.
+		journal.provisioning.UpdatedAt = updatedAt
+	}
+	return err
+}
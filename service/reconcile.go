@@ -0,0 +1,279 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type DriftKind string
+
+const (
+	// A vault account in Fireblocks that none of our wallets belong to.
+	DriftOrphanedVault DriftKind = "orphaned_vault"
+	// A wallet we have that doesn't match any vault account in Fireblocks.
+	DriftMissingVault DriftKind = "missing_vault"
+	// A vault account that lacks one of the assets we expect.
+	DriftMissingAsset DriftKind = "missing_asset"
+	// A wallet whose stored address isn't among its vault asset's addresses.
+	DriftAddressMismatch DriftKind = "address_mismatch"
+)
+
+// A single discrepancy between the database and Fireblocks.
+type Drift struct {
+	Kind           DriftKind `json:"kind"`
+	VaultAccountID string    `json:"vault_account_id,omitempty"`
+	AssetID        string    `json:"asset_id,omitempty"`
+	WalletID       uint      `json:"wallet_id,omitempty"`
+	Expected       string    `json:"expected,omitempty"`
+	Actual         string    `json:"actual,omitempty"`
+	// Whether we fixed this by adopting the vault account into the pool.
+	Adopted bool `json:"adopted,omitempty"`
+}
+
+type DriftReport struct {
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	VaultAccounts int       `json:"vault_accounts"`
+	Wallets       int       `json:"wallets"`
+	Drift         []Drift   `json:"drift"`
+}
+
+// A WalletProvider whose accounts can be listed, so we can reconcile our
+// wallets against them.
+type ListingProvider interface {
+	WalletProvider
+	// Every account the provider has, other than retired ones, with its
+	// addresses for each of the given assets, fetching pageSize at a time
+	// if it pages (zero for its default).
+	Accounts(ctx context.Context, assets []Asset, pageSize int) iter.Seq2[ListedAccount, error]
+}
+
+// An account as listed by a ListingProvider.
+type ListedAccount struct {
+	ID string
+	// The account's addresses for each asset, by asset ID, as Lookup would
+	// return them.
+	Addresses map[string][]string
+}
+
+// Reconciler compares our wallets against the accounts that actually exist in
+// the provider, e.g. Fireblocks vault accounts.
+type Reconciler struct {
+	DB       *gorm.DB
+	Provider ListingProvider
+	// Adopt orphaned vault accounts into the pool, creating any missing
+	// assets, rather than only reporting them. A vault account that's just
+	// been created looks orphaned until it's journaled, so nothing is
+	// adopted while any provisioning is waiting on its vault account.
+	Adopt bool
+	// Number of vault accounts to fetch per request.
+	PageSize int
+	// The assets we expect to find, DefaultCatalog if nil.
+	Assets Catalog
+}
+
+func (r *Reconciler) catalog() Catalog {
+	if r.Assets == nil {
+		return DefaultCatalog
+	}
+	return r.Assets
+}
+
+// The wallet's addresses by asset ID.
+func walletAddresses(wallet *Wallet) map[string]Address {
+	addresses := make(map[string]Address)
+	for _, address := range wallet.Addresses {
+		addresses[address.AssetID] = address
+	}
+	return addresses
+}
+
+// An address the provider gave for an asset, normalized like we store it, so
+// it matches however either of us wrote it.
+func (r *Reconciler) normalize(assetId, address string) string {
+	if asset, ok := r.catalog().Asset(assetId); ok {
+		return asset.AddressFormat.Normalize(address)
+	}
+	return address
+}
+
+// Report whether a provisioning is still waiting to record its vault account.
+// Any such provisioning may be the one that created an orphaned-looking vault
+// account, since it journals that it's started before creating the vault
+// account and only records it afterwards.
+func (r *Reconciler) awaitingAccount() (bool, error) {
+	var pending int64
+	err := r.DB.Model(&Provisioning{}).
+		Where("state = ? AND vault_account_id = ''", ProvisioningPending).
+		Count(&pending).Error
+	return pending > 0, err
+}
+
+// Adopt an orphaned vault account into the pool, creating whatever assets it
+// lacks.
+func (r *Reconciler) adopt(ctx context.Context, accountId string, addresses map[string][]string) error {
+	now := provisioningTime()
+	provisioning := Provisioning{
+		Model:          gorm.Model{CreatedAt: now, UpdatedAt: now},
+		VaultAccountID: accountId,
+		State:          ProvisioningPending,
+		Attempts:       1,
+	}
+	for assetId, assetAddresses := range addresses {
+		if len(assetAddresses) > 0 {
+			provisioning.Assets = append(provisioning.Assets, ProvisionedAsset{AssetID: assetId, Address: assetAddresses[0]})
+		}
+	}
+	if err := r.DB.Create(&provisioning).Error; err != nil {
+		return err
+	}
+
+	journal := newJournal(r.DB, &provisioning)
+	wallet, err := newWallet(ctx, r.Provider, r.catalog().Enabled(), journal)
+	if err != nil {
+		return err
+	}
+	return storeWallet(r.DB, wallet, journal)
+}
+
+// Compare every account the provider has with our wallets and report the
+// differences.
+func (r *Reconciler) Reconcile(ctx context.Context) (*DriftReport, error) {
+	report := DriftReport{StartedAt: time.Now(), Drift: []Drift{}}
+
+	var wallets []Wallet
+	if err := r.DB.Preload("Addresses").Find(&wallets).Error; err != nil {
+		return nil, err
+	}
+	report.Wallets = len(wallets)
+
+	walletsByVault := make(map[string]*Wallet)
+	walletsByAddress := make(map[string]*Wallet)
+	for i := range wallets {
+		if wallets[i].VaultAccountID != "" {
+			walletsByVault[wallets[i].VaultAccountID] = &wallets[i]
+		}
+		for _, address := range walletAddresses(&wallets[i]) {
+			walletsByAddress[address.Format.Normalize(address.Address)] = &wallets[i]
+		}
+	}
+
+	var journals []Provisioning
+	if err := r.DB.Where("vault_account_id != ''").Find(&journals).Error; err != nil {
+		return nil, err
+	}
+	journalsByVault := make(map[string]*Provisioning)
+	for i := range journals {
+		journalsByVault[journals[i].VaultAccountID] = &journals[i]
+	}
+
+	seen := make(map[uint]bool)
+	for account, err := range r.Provider.Accounts(ctx, r.catalog(), r.PageSize) {
+		if err != nil {
+			return nil, fmt.Errorf("failed to list vault accounts: %w", err)
+		}
+		accountId, addresses := account.ID, account.Addresses
+
+		report.VaultAccounts++
+
+		// Pending accounts are still being provisioned, which will sort
+		// themselves out.
+		if journal, ok := journalsByVault[accountId]; ok && journal.State != ProvisioningComplete {
+			continue
+		}
+
+		// Wallets from before we recorded their vault account can only
+		// be matched by address.
+		wallet := walletsByVault[accountId]
+		for assetId, assetAddresses := range addresses {
+			for _, address := range assetAddresses {
+				if w, ok := walletsByAddress[r.normalize(assetId, address)]; ok && wallet == nil {
+					wallet = w
+				}
+			}
+		}
+
+		if wallet == nil {
+			// The pool may have journaled it since we looked, since
+			// reconciling runs alongside it.
+			var journals int64
+			if err := r.DB.Model(&Provisioning{}).Where("vault_account_id = ?", accountId).Count(&journals).Error; err != nil {
+				return nil, err
+			}
+			if journals > 0 {
+				continue
+			}
+
+			drift := Drift{Kind: DriftOrphanedVault, VaultAccountID: accountId}
+			if r.Adopt {
+				// We listed the vault account after whoever created
+				// it journaled that they'd started, so checking now
+				// can't miss them.
+				awaiting, err := r.awaitingAccount()
+				if err != nil {
+					return nil, err
+				}
+				if awaiting {
+					log.Printf("Not adopting vault account %s while a provisioning is waiting on its vault account\n", accountId)
+					report.Drift = append(report.Drift, drift)
+					continue
+				}
+				if err := r.adopt(ctx, accountId, addresses); err != nil {
+					return nil, fmt.Errorf("failed to adopt vault account %s: %w", accountId, err)
+				}
+				drift.Adopted = true
+			}
+			report.Drift = append(report.Drift, drift)
+			continue
+		}
+
+		seen[wallet.ID] = true
+		expectedAddresses := walletAddresses(wallet)
+		for _, assetId := range slices.Sorted(maps.Keys(expectedAddresses)) {
+			assetAddresses, ok := addresses[assetId]
+			if !ok {
+				report.Drift = append(report.Drift, Drift{
+					Kind:           DriftMissingAsset,
+					VaultAccountID: accountId,
+					AssetID:        assetId,
+					WalletID:       wallet.ID,
+				})
+				continue
+			}
+
+			expected := expectedAddresses[assetId]
+			matches := func(address string) bool {
+				return expected.Format.Normalize(address) == expected.Format.Normalize(expected.Address)
+			}
+			if !slices.ContainsFunc(assetAddresses, matches) {
+				drift := Drift{
+					Kind:           DriftAddressMismatch,
+					VaultAccountID: accountId,
+					AssetID:        assetId,
+					WalletID:       wallet.ID,
+					Expected:       expected.Address,
+				}
+				if len(assetAddresses) > 0 {
+					drift.Actual = assetAddresses[0]
+				}
+				report.Drift = append(report.Drift, drift)
+			}
+		}
+	}
+
+	for _, wallet := range wallets {
+		if !seen[wallet.ID] {
+			report.Drift = append(report.Drift, Drift{Kind: DriftMissingVault, WalletID: wallet.ID})
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	return &report, nil
+}
@@ -1,45 +1,133 @@
 package service
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/google/uuid"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/fionn/address-manager/service/fireblocks"
 	"github.com/fionn/address-manager/utils"
 )
 
 const databaseFile = "adhoc.db"
+
+// The database if DATABASE_URL isn't set. Wait on locks rather than failing
+// immediately, since other replicas may be writing to the same database.
+const databaseDSN = databaseFile + "?_busy_timeout=5000"
 const fbBaseURL = "http://localhost:6200"
 
+// How often to recheck an empty pool while waiting for a wallet.
+const poolRecheckInterval = 100 * time.Millisecond
+
+// How many times CreateUser tries provisioning a wallet inline.
+const inlineProvisioningAttempts = 2
+
+// Number of wallets put back in the pool because allocating them to a user
+// failed after they were claimed.
+var WalletsReturned = expvar.NewInt("wallets_returned_to_pool")
+
+// ErrPoolEmpty is returned when there are no unassigned wallets to claim.
+var ErrPoolEmpty = errors.New("wallet pool is empty")
+
+// PoolExhaustedError is returned when we gave up waiting for a wallet.
+type PoolExhaustedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *PoolExhaustedError) Error() string {
+	return fmt.Sprintf("wallet pool exhausted, retry after %s", e.RetryAfter)
+}
+
+func (e *PoolExhaustedError) Unwrap() error {
+	return ErrPoolEmpty
+}
+
 type Data struct {
-	DB      *gorm.DB
-	Wallets <-chan Wallet
+	DB *gorm.DB
+	// If set, notified whenever a wallet is taken from the pool, and used to
+	// provision wallets inline if SyncFallback is set.
+	Pool *WalletPool
+	// How long CreateUser waits for the pool to be refilled if it's empty.
+	AllocationTimeout time.Duration
+	// Whether CreateUser provisions a wallet itself if the pool stays empty.
+	SyncFallback bool
 }
 
+// Configure allocation from ALLOCATION_TIMEOUT (default 5s, zero to not wait)
+// and SYNC_FALLBACK (default true).
+func DataFromEnv(db *gorm.DB, pool *WalletPool) (*Data, error) {
+	data := Data{DB: db, Pool: pool, AllocationTimeout: 5 * time.Second, SyncFallback: true}
+	if s := os.Getenv("ALLOCATION_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ALLOCATION_TIMEOUT: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("invalid ALLOCATION_TIMEOUT: %s is negative", d)
+		}
+		data.AllocationTimeout = d
+	}
+	if s := os.Getenv("SYNC_FALLBACK"); s != "" {
+		fallback, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SYNC_FALLBACK: %w", err)
+		}
+		data.SyncFallback = fallback
+	}
+	return &data, nil
+}
+
+// Wallet groups a user's addresses, one for each asset that was enabled when
+// it was provisioned.
 type Wallet struct {
-	// This is very lossy and we're probably better off keeping the general
-	// structure of the Fireblocks API responses, but not 1:1 since we don't
-	// want to rely on Fireblocks keeping their API stable for our database
-	// schema.
 	gorm.Model
+	// The provider's account holding the wallet's addresses, e.g. a
+	// Fireblocks vault account, so we can find the wallet from a webhook.
+	VaultAccountID string `gorm:"index"`
+	Addresses      []Address
+	// Deprecated: use Addresses. These predate the address table, and are
+	// still written for BTC and SOL so existing clients, and replicas that
+	// haven't been upgraded yet, keep working.
 	AddressBTC string
 	AddressSOL string
-	UserID     uuid.UUID
+	// The index AddressBTC was derived at, if it came from an HD provider.
+	DerivationIndex *uint32 `json:",omitempty"`
+	// Null while the wallet is unassigned and sitting in the pool.
+	UserID *uuid.UUID `gorm:"index"`
+}
+
+// The wallet's address for an asset, if it has one.
+func (w *Wallet) Address(assetId string) (Address, bool) {
+	i := slices.IndexFunc(w.Addresses, func(address Address) bool { return address.AssetID == assetId })
+	if i < 0 {
+		return Address{}, false
+	}
+	return w.Addresses[i], true
 }
 
 type User struct {
-	ID        uuid.UUID `gorm:"primarykey"`
+	// Generated by the database on PostgreSQL, otherwise by BeforeCreate.
+	ID        uuid.UUID `gorm:"primarykey;default:(-)"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
@@ -47,83 +135,273 @@ type User struct {
 }
 
 func (u *User) BeforeCreate(tx *gorm.DB) error {
+	// Callers may pick the ID themselves, e.g. to reference the user before
+	// it's created, and PostgreSQL generates one otherwise.
+	if u.ID != uuid.Nil || tx.Dialector.Name() == "postgres" {
+		return nil
+	}
 	uuid := uuid.New()
 	tx.Statement.SetColumn("ID", uuid)
 	return nil
 }
 
-// Create a wallet.
-func newWallet(fb *fireblocks.Fireblocks) (*Wallet, error) {
-	fbVaultAccount, err := fb.CreateVaultAccount()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create vault account: %s", err)
+// Claim an unassigned wallet for a user, without its addresses. This is safe
+// to run concurrently from several replicas sharing a database: on PostgreSQL
+// we lock the row and skip any already locked by another transaction,
+// elsewhere (i.e. SQLite, which serialises writers) we claim with a single
+// guarded update.
+func claimWallet(tx *gorm.DB, userID uuid.UUID) (*Wallet, error) {
+	var wallet Wallet
+
+	if tx.Dialector.Name() == "postgres" {
+		err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate, Options: clause.LockingOptionsSkipLocked}).
+			Where("user_id IS NULL").Order("id").Take(&wallet).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrPoolEmpty
+			}
+			return nil, err
+		}
+		if err := tx.Model(&wallet).Update("user_id", userID).Error; err != nil {
+			return nil, err
+		}
+		return &wallet, nil
 	}
 
-	// By default the above call creates an Ethereum wallet for us, but we want
-	// to support Bitcoin and Solana so we have to create them separately.
-	fbVaultWalletBTC, err := fb.CreateVaultAccountAsset(fbVaultAccount.ID, "BTC")
+	unassigned := tx.Model(&Wallet{}).Select("id").Where("user_id IS NULL").Order("id").Limit(1)
+	result := tx.Model(&Wallet{}).
+		Where("id = (?) AND user_id IS NULL", unassigned).
+		Update("user_id", userID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrPoolEmpty
+	}
+	if err := tx.Where("user_id = ?", userID).Take(&wallet).Error; err != nil {
+		return nil, err
+	}
+	return &wallet, nil
+}
+
+// Create a user and assign them a wallet from the pool. The wallet is claimed
+// in the same transaction as the user is created, so it's only consumed if
+// the user is committed.
+func (d *Data) createUserFromPool() (*User, error) {
+	user := User{}
+	claimed := false
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		// Create the user first, so the database can assign its ID, which
+		// also takes the write lock up front on SQLite. If the pool's
+		// empty, it's rolled back.
+		if err := tx.Omit(clause.Associations).Create(&user).Error; err != nil {
+			return err
+		}
+
+		wallet, err := claimWallet(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		claimed = true
+
+		if err := tx.Where("wallet_id = ?", wallet.ID).Find(&wallet.Addresses).Error; err != nil {
+			return err
+		}
+		user.Wallet = *wallet
+		return nil
+	})
+	if d.Pool != nil {
+		d.Pool.Notify()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to create BTC asset for account %s: %s", fbVaultAccount.ID, err)
+		if claimed {
+			// The rollback leaves the wallet unassigned in the pool.
+			WalletsReturned.Add(1)
+		}
+		return nil, err
 	}
-	fbVaultWalletSOL, err := fb.CreateVaultAccountAsset(fbVaultAccount.ID, "SOL")
+	return &user, nil
+}
+
+// Create a user with a freshly provisioned wallet, bypassing the pool but
+// provisioning the way it does, behind its circuit breaker.
+func (d *Data) createUserWithNewWallet(ctx context.Context) (*User, error) {
+	// Someone's waiting on this, so don't retry for as long as the pool
+	// would.
+	retry := d.Pool.Retry
+	retry.MaxAttempts = inlineProvisioningAttempts
+	wallet, journal, err := d.Pool.newWallet(ctx, retry)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create SOL asset for account %s: %s", fbVaultAccount.ID, err)
+		return nil, err
 	}
 
-	wallet := Wallet{
-		AddressBTC: fbVaultWalletBTC.Address,
-		AddressSOL: fbVaultWalletSOL.Address,
+	user := User{}
+	err = storeWalletWith(d.DB, wallet, journal, func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Create(&user).Error; err != nil {
+			return err
+		}
+		wallet.UserID = &user.ID
+		return nil
+	})
+	if err != nil {
+		// Don't orphan the vault we just paid for; put it in the pool.
+		wallet.ID = 0
+		wallet.UserID = nil
+		for i := range wallet.Addresses {
+			wallet.Addresses[i].ID = 0
+			wallet.Addresses[i].WalletID = 0
+		}
+		if err := d.Pool.store(ctx, wallet, journal); err != nil {
+			log.Printf("Failed to return wallet to the pool: %s", err)
+		} else {
+			WalletsReturned.Add(1)
+		}
+		return nil, err
 	}
+	user.Wallet = *wallet
+	return &user, nil
+}
 
-	return &wallet, nil
+// Suggest how long a client should wait before retrying after the pool was
+// exhausted.
+func (d *Data) retryAfter() time.Duration {
+	if d.Pool != nil && d.Pool.Retry.Breaker != nil {
+		return max(d.Pool.Retry.Breaker.Remaining(), time.Second)
+	}
+	return time.Second
 }
 
-// Keep the wallet pool populated.
-func PopulateWalletPool(c chan<- Wallet, ctx context.Context, threshold int, fb *fireblocks.Fireblocks) {
+// Create a user and assign them a wallet. If the pool is empty, wait up to
+// AllocationTimeout for it to be refilled, then either provision a wallet
+// inline (if SyncFallback is set) or give up with a *PoolExhaustedError.
+func (d *Data) CreateUser(ctx context.Context) (*User, error) {
+	waitCtx := ctx
+	if d.AllocationTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, d.AllocationTimeout)
+		defer cancel()
+	}
+
 	for {
+		// Take this before trying to claim, so we can't miss a wallet that's
+		// added in between.
+		var added <-chan struct{}
+		if d.Pool != nil {
+			added = d.Pool.Added()
+		}
+
+		user, err := d.createUserFromPool()
+		if !errors.Is(err, ErrPoolEmpty) {
+			return user, err
+		}
+		if d.AllocationTimeout <= 0 {
+			break
+		}
+
+		// Other replicas don't tell us when they add to the pool, so check
+		// periodically too.
+		timer := time.NewTimer(poolRecheckInterval)
 		select {
-		case <-ctx.Done():
-			log.Println("Cancelling wallet pool population")
-			return
-		default:
-			for len(c) < threshold {
-				wallet, err := newWallet(fb)
-				if err != nil {
-					log.Printf("Failed to create wallet: %s\n", err)
-					time.Sleep(1 * time.Second) // TODO: exponential backoff with cap.
-					continue
-				}
-				c <- *wallet
-			}
-			// Sleep to cool this loop down, otherwise it will churn the CPU.
-			// TODO: choose an optimal duration.
-			// TODO: consider "waking up" the loop on allocation (e.g. with
-			//       another context).
-			time.Sleep(500 * time.Millisecond)
+		case <-added:
+		case <-timer.C:
+		case <-waitCtx.Done():
+		}
+		timer.Stop()
+		if waitCtx.Err() != nil {
+			break
 		}
 	}
-}
 
-func (d *Data) CreateUser() (*User, error) {
-	user := User{Wallet: <-d.Wallets}
-	if tx := d.DB.Create(&user); tx.Error != nil {
-		return nil, tx.Error
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return &user, nil
+
+	// Don't try the provider ourselves while it's known to be down.
+	breakerOpen := d.Pool != nil && d.Pool.Retry.Breaker != nil && d.Pool.Retry.Breaker.State() == fireblocks.BreakerOpen
+	if d.SyncFallback && d.Pool != nil && !breakerOpen {
+		log.Print("Wallet pool exhausted, provisioning a wallet inline")
+		user, err := d.createUserWithNewWallet(ctx)
+		if err == nil {
+			return user, nil
+		}
+		log.Printf("Failed to provision a wallet inline: %s", err)
+	}
+
+	return nil, &PoolExhaustedError{RetryAfter: d.retryAfter()}
 }
 
 func (d Data) GetUser(id uuid.UUID) (*User, error) {
 	user := User{}
-	if tx := d.DB.Model(&user).Preload("Wallet").Take(&user, id); tx.Error != nil {
+	if tx := d.DB.Model(&user).Preload("Wallet.Addresses").Take(&user, id); tx.Error != nil {
 		return nil, tx.Error
 	}
 	return &user, nil
 }
 
-func (d *Data) handlePostCreateUser(w http.ResponseWriter, _ *http.Request) {
-	user, err := d.CreateUser()
+// Who an address belongs to.
+type AddressOwner struct {
+	WalletID uint
+	// The address for each of the wallet's assets that use it, e.g. ETH and
+	// its tokens.
+	Addresses []Address
+	// Nil while the wallet is in the pool, waiting for a user.
+	User *User
+}
+
+// Find who owns an address, however its case is written if that doesn't
+// matter for its format. Other encodings of an address, e.g. a legacy Bitcoin
+// address, are found too, but only written exactly as Fireblocks gave them.
+// Addresses that need a tag are shared between wallets, so are only found
+// with their tag. Returns gorm.ErrRecordNotFound if it isn't one of ours.
+func (d Data) LookupAddress(address string, tag string) (*AddressOwner, error) {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	// Addresses are stored normalized, lower case if their format ignores
+	// case, so look for it either way and keep those whose format agrees.
+	// Every match is in the same wallet, since an address only has one, and
+	// its other encodings are derived from it.
+	var found []Address
+	err := d.DB.Where("(normalized_address IN ? OR legacy_address = ? OR enterprise_address = ?) AND tag = ?",
+		[]string{address, strings.ToLower(address)}, address, address, tag).
+		Order("id").Find(&found).Error
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	found = slices.DeleteFunc(found, func(a Address) bool {
+		return a.Format.Normalize(address) != a.NormalizedAddress && a.LegacyAddress != address && a.EnterpriseAddress != address
+	})
+	if len(found) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	owner := AddressOwner{WalletID: found[0].WalletID, Addresses: found}
+	var wallet Wallet
+	if err := d.DB.Take(&wallet, owner.WalletID).Error; err != nil {
+		return nil, err
+	}
+	if wallet.UserID != nil {
+		if owner.User, err = d.GetUser(*wallet.UserID); err != nil {
+			return nil, err
+		}
+	}
+	return &owner, nil
+}
+
+func (d *Data) handlePostCreateUser(w http.ResponseWriter, r *http.Request) {
+	user, err := d.CreateUser(r.Context())
+	if err != nil {
+		var exhausted *PoolExhaustedError
+		if errors.As(err, &exhausted) {
+			retryAfter := int(math.Ceil(exhausted.RetryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		} else {
+			log.Printf("Failed to create user: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 
@@ -173,38 +451,313 @@ func (d Data) handleGetUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func Run() {
-	db, err := gorm.Open(sqlite.Open(databaseFile), &gorm.Config{})
+func (d Data) handleGetAddress(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	owner, err := d.LookupAddress(address, r.URL.Query().Get("tag"))
 	if err != nil {
-		log.Fatalf("Failed to connect to the database: %s", err)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			err := fmt.Errorf("failed to look up address %s: %s", address, err)
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
 	}
 
-	fb := fireblocks.NewFireblocksSession(fbBaseURL)
+	response, err := json.MarshalIndent(owner, "", "  ")
+	if err != nil {
+		log.Printf("Failed to marshal owner of address %s: %s", address, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	err = db.AutoMigrate(&User{}, &Wallet{})
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(utils.BinaryNewline(response))
 	if err != nil {
-		log.Fatalf("Failed to automigrate: %s", err)
+		log.Printf("Error writing response: %s", err)
 	}
+}
 
-	threshold := 30
-	walletChannel := make(chan Wallet, threshold)
-	defer close(walletChannel)
+// Health of the service and its dependencies.
+type Health struct {
+	Database string `json:"database"`
+	// The wallet provider, e.g. Fireblocks.
+	Provider string `json:"provider"`
+}
+
+func (d Data) handleGetHealth(w http.ResponseWriter, r *http.Request) {
+	health := Health{Database: "ok", Provider: "unknown"}
+	status := http.StatusOK
+
+	if db, err := d.DB.DB(); err != nil {
+		health.Database = err.Error()
+		status = http.StatusServiceUnavailable
+	} else if err := db.PingContext(r.Context()); err != nil {
+		health.Database = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+
+	if d.Pool != nil && d.Pool.Retry.Breaker != nil {
+		// The breaker is half-open while probing whether the provider has
+		// recovered, which we don't yet know, so only report open as down.
+		state := d.Pool.Retry.Breaker.State()
+		health.Provider = "circuit " + state.String()
+		if state == fireblocks.BreakerOpen {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	response, err := json.MarshalIndent(health, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(utils.BinaryNewline(response))
+	if err != nil {
+		log.Printf("Error writing response: %s", err)
+	}
+}
+
+// Pool size and state, for the admin endpoint.
+type PoolStatus struct {
+	PoolTarget
+	Available int64 `json:"available"`
+}
+
+func (d *Data) handleGetPool(w http.ResponseWriter, r *http.Request) {
+	if d.Pool == nil {
+		http.Error(w, "no wallet pool", http.StatusServiceUnavailable)
+		return
+	}
+
+	available, err := CountPoolWallets(d.DB)
+	if err != nil {
+		err := fmt.Errorf("failed to count pool wallets: %s", err)
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.MarshalIndent(PoolStatus{PoolTarget: d.Pool.Target(), Available: available}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(utils.BinaryNewline(response))
+	if err != nil {
+		log.Printf("Error writing response: %s", err)
+	}
+}
 
-	ctx, cancelWalletPool := context.WithCancel(context.Background())
-	defer cancelWalletPool()
-	go PopulateWalletPool(walletChannel, ctx, threshold, &fb)
+func (d *Data) handlePostReconcile(w http.ResponseWriter, r *http.Request) {
+	var provider ListingProvider
+	if d.Pool != nil {
+		provider, _ = d.Pool.Provider.(ListingProvider)
+	}
+	if provider == nil {
+		http.Error(w, "wallet provider can't be reconciled against", http.StatusServiceUnavailable)
+		return
+	}
+
+	adopt, _ := strconv.ParseBool(r.URL.Query().Get("adopt"))
+	reconciler := Reconciler{DB: d.DB, Provider: provider, Adopt: adopt, Assets: d.Pool.Assets}
+	report, err := reconciler.Reconcile(r.Context())
+	if err != nil {
+		err := fmt.Errorf("failed to reconcile: %s", err)
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	data := Data{DB: db, Wallets: walletChannel}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(utils.BinaryNewline(response))
+	if err != nil {
+		log.Printf("Error writing response: %s", err)
+	}
+}
 
+// The service's HTTP API.
+func (d *Data) Handler() http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Get("/user/{userId}", data.handleGetUser)
-	r.Post("/user", data.handlePostCreateUser)
+	r.Get("/user/{userId}", d.handleGetUser)
+	r.Post("/user", d.handlePostCreateUser)
+	r.Get("/address/{address}", d.handleGetAddress)
+	r.Get("/health", d.handleGetHealth)
+	r.Get("/admin/pool", d.handleGetPool)
+	r.Post("/admin/reconcile", d.handlePostReconcile)
+	r.Handle("/debug/vars", expvar.Handler())
+	return r
+}
+
+// A Fireblocks provider configured from the environment.
+func newFireblocksProvider() (*FireblocksProvider, error) {
+	var fbOptions []fireblocks.Option
+	if privateKeyFile := os.Getenv("FIREBLOCKS_PRIVATE_KEY"); privateKeyFile != "" {
+		credentials, err := fireblocks.LoadCredentials(os.Getenv("FIREBLOCKS_API_KEY"), privateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load credentials: %w", err)
+		}
+		fbOptions = append(fbOptions, fireblocks.WithCredentials(credentials))
+	}
+	fbOptions = append(fbOptions,
+		fireblocks.WithUserAgent("address-manager"),
+		// Stay well inside Fireblocks' per-key limits, so refilling the
+		// pool doesn't starve everything else of requests.
+		fireblocks.WithRateLimit(fireblocks.ClassWrite, 10, 20),
+		fireblocks.WithRateLimit(fireblocks.ClassRead, 20, 40),
+	)
+	fb, err := fireblocks.NewFireblocksSession(fbBaseURL, fbOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return &FireblocksProvider{Fireblocks: fb}, nil
+}
+
+func openDatabase() (*gorm.DB, error) {
+	config, err := DatabaseConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return OpenDatabase(config)
+}
+
+func Run() {
+	// Everything below, including in-flight Fireblocks calls, is cancelled
+	// when we're asked to stop.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := openDatabase()
+	if err != nil {
+		log.Fatalf("Failed to connect to the database: %s", err)
+	}
+
+	// Migrating is left to the migrate subcommand, so it happens once per
+	// deploy rather than racing between replicas.
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %s", err)
+	}
+	if err := migrator.Check(); errors.Is(err, ErrSchemaAhead) {
+		// Newer replicas have migrated during a rolling deploy, and
+		// migrations keep the schema working for the release before.
+		log.Printf("Schema is newer than this build: %s", err)
+	} else if errors.Is(err, ErrSchemaBehind) {
+		log.Fatalf("Refusing to start: %s, run the migrate up subcommand first", err)
+	} else if err != nil {
+		log.Fatalf("Refusing to start: %s", err)
+	}
+
+	catalog, err := catalogFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to load asset catalog: %s", err)
+	}
+
+	var provider WalletProvider
+	reconcileDone := make(chan struct{})
+	switch name := os.Getenv("WALLET_PROVIDER"); name {
+	case "", "fireblocks":
+		fbProvider, err := newFireblocksProvider()
+		if err != nil {
+			log.Fatalf("Failed to set up Fireblocks: %s", err)
+		}
+		provider = fbProvider
+
+		// Report (but don't fix) any drift from Fireblocks. Listing every
+		// vault account takes a while, so we don't hold up serving for it.
+		reconciler := Reconciler{DB: db, Provider: fbProvider, Assets: catalog}
+		go func() {
+			defer close(reconcileDone)
+			if report, err := reconciler.Reconcile(ctx); err != nil {
+				log.Printf("Failed to reconcile with Fireblocks: %s", err)
+			} else {
+				log.Printf("Reconciled %d wallets with %d vault accounts, found %d discrepancies",
+					report.Wallets, report.VaultAccounts, len(report.Drift))
+				for _, drift := range report.Drift {
+					log.Printf("Drift: %+v", drift)
+				}
+			}
+		}()
+	case "hd":
+		close(reconcileDone)
+		taproot, _ := strconv.ParseBool(os.Getenv("HD_TAPROOT"))
+		hdProvider, err := NewHDProvider(db, os.Getenv("HD_EXTENDED_KEY"), cmp.Or(os.Getenv("HD_NETWORK"), "testnet"), taproot)
+		if err != nil {
+			log.Fatalf("Failed to create HD provider: %s", err)
+		}
+		if err := hdProvider.CheckAssets(catalog); err != nil {
+			log.Fatalf("Asset catalog doesn't suit the HD provider: %s", err)
+		}
+		provider = hdProvider
+	default:
+		log.Fatalf("Unknown wallet provider %q", name)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("Failed to get hostname: %s", err)
+	}
+	lease := Lease{
+		DB:     db,
+		Name:   "wallet_pool",
+		Holder: fmt.Sprintf("%s/%d", hostname, os.Getpid()),
+		Slots:  1,
+		TTL:    30 * time.Second,
+	}
+	pool := NewWalletPool(db, provider, 20, 30)
+	pool.Assets = catalog
+	pool.Lease = &lease
+	pool.Workers = 8
+	pool.ProvisionInterval = 50 * time.Millisecond
+	pool.Sizer, err = PoolSizerFromEnv(db)
+	if err != nil {
+		log.Fatalf("Failed to configure pool sizing: %s", err)
+	}
+	poolDone := make(chan struct{})
+	go func() {
+		defer close(poolDone)
+		pool.Run(ctx)
+	}()
+
+	data, err := DataFromEnv(db, pool)
+	if err != nil {
+		log.Fatalf("Failed to configure allocation: %s", err)
+	}
+
+	server := &http.Server{
+		Addr:        "localhost:6201",
+		Handler:     data.Handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		log.Print("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down gracefully: %s", err)
+			server.Close()
+		}
+	}()
 
-	address := "localhost:6201"
-	log.Printf("listening on http://%s/", address)
-	if err := http.ListenAndServe(address, r); err != nil && err != http.ErrServerClosed {
+	log.Printf("listening on http://%s/", server.Addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-poolDone
+	<-reconcileDone
 }
@@ -1,9 +1,24 @@
 package service_test
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,7 +27,7 @@ import (
 
 	"github.com/fionn/address-manager/fb_mock"
 
-	"gorm.io/driver/sqlite"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
@@ -20,104 +35,2079 @@ const databaseFile = "test.db"
 const fbBaseHost = "localhost:6200"
 const fbBaseURL = "http://" + fbBaseHost
 
+// Which database the tests run against, sqlite (the default) or postgres.
+var testDatabase = cmp.Or(os.Getenv("TEST_DATABASE"), "sqlite")
+
+// With TEST_DATABASE=postgres, the server to create each test's database on:
+// TEST_POSTGRES_URL if it's set, otherwise one TestMain starts.
+var postgresURL = os.Getenv("TEST_POSTGRES_URL")
+
+var (
+	// Connected to postgresURL, to create databases with.
+	postgresAdmin *gorm.DB
+	// How many databases we've created, to name the next.
+	postgresDatabases int
+	// The last test's database, which we close so we don't run out of
+	// connections.
+	lastDB *gorm.DB
+)
+
+func TestMain(m *testing.M) {
+	stop := func() {}
+	if testDatabase == "postgres" {
+		var err error
+		if postgresURL == "" {
+			postgresURL, stop, err = startPostgres()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to start PostgreSQL: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		postgresAdmin, err = service.OpenDatabase(service.DatabaseConfig{DSN: postgresURL})
+		if err != nil {
+			stop()
+			fmt.Fprintf(os.Stderr, "Failed to connect to PostgreSQL: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+// Find PostgreSQL's server binaries, on the path or where Debian and Ubuntu
+// install them.
+func postgresBin() (string, error) {
+	if path, err := exec.LookPath("pg_ctl"); err == nil {
+		return filepath.Dir(path), nil
+	}
+	dirs, _ := filepath.Glob("/usr/lib/postgresql/*/bin")
+	slices.Sort(dirs)
+	// pg_config comes with the client library too, so may point at a server
+	// that isn't installed.
+	if out, err := exec.Command("pg_config", "--bindir").Output(); err == nil {
+		dirs = append(dirs, strings.TrimSpace(string(out)))
+	}
+	for _, dir := range slices.Backward(dirs) {
+		if _, err := os.Stat(filepath.Join(dir, "pg_ctl")); err == nil {
+			return dir, nil
+		}
+	}
+	return "", errors.New("no PostgreSQL installation found")
+}
+
+// Start a throwaway PostgreSQL server, listening only on a Unix socket in a
+// temporary directory, returning its URL and how to stop it.
+func startPostgres() (string, func(), error) {
+	bin, err := postgresBin()
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := os.MkdirTemp("", "pg")
+	if err != nil {
+		return "", nil, err
+	}
+	data := filepath.Join(dir, "data")
+
+	initdb := exec.Command(filepath.Join(bin, "initdb"), "-D", data, "-U", "postgres", "--auth=trust", "--no-sync")
+	if out, err := initdb.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("initdb failed: %w: %s", err, out)
+	}
+	options := fmt.Sprintf("-k %s -c listen_addresses='' -c fsync=off -c max_connections=500", dir)
+	start := exec.Command(filepath.Join(bin, "pg_ctl"), "-D", data, "-l", filepath.Join(dir, "log"), "-o", options, "-w", "start")
+	if out, err := start.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("pg_ctl start failed: %w: %s", err, out)
+	}
+
+	stop := func() {
+		exec.Command(filepath.Join(bin, "pg_ctl"), "-D", data, "-m", "immediate", "stop").Run() //nolint:errcheck
+		os.RemoveAll(dir)
+	}
+	return "postgres://postgres@/postgres?host=" + url.QueryEscape(dir), stop, nil
+}
+
+// An empty database, without any migrations applied.
+func openDatabase() (*gorm.DB, error) {
+	if testDatabase != "postgres" {
+		os.Remove(databaseFile)
+		return service.OpenDatabase(service.DatabaseConfig{DSN: databaseFile + "?_busy_timeout=5000"})
+	}
+
+	if lastDB != nil {
+		if db, err := lastDB.DB(); err == nil {
+			db.Close()
+		}
+	}
+	postgresDatabases++
+	name := fmt.Sprintf("address_manager_test_%d", postgresDatabases)
+	if err := postgresAdmin.Exec("DROP DATABASE IF EXISTS " + name + " WITH (FORCE)").Error; err != nil {
+		return nil, err
+	}
+	if err := postgresAdmin.Exec("CREATE DATABASE " + name).Error; err != nil {
+		return nil, err
+	}
+	dsn, err := url.Parse(postgresURL)
+	if err != nil {
+		return nil, err
+	}
+	dsn.Path = "/" + name
+	db, err := service.OpenDatabase(service.DatabaseConfig{DSN: dsn.String()})
+	lastDB = db
+	return db, err
+}
+
 func setupDatabase() (*gorm.DB, error) {
-	os.Remove(databaseFile)
-	db, err := gorm.Open(sqlite.Open(databaseFile), &gorm.Config{})
+	db, err := openDatabase()
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.AutoMigrate(&service.User{}, &service.Wallet{})
+	migrator, err := service.NewMigrator(db)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := migrator.Up(); err != nil {
+		return nil, err
+	}
 	return db, nil
 }
 
 func setupMock(address string) (*sync.WaitGroup, context.CancelFunc) {
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	ctx, stopMock := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
 	go fb_mock.RunWithCancellation(ctx, wg, address)
+
+	// Drop pooled connections too, so the next test can't reuse one that's
+	// still talking to this mock (and its state).
+	stopMock := func() {
+		cancel()
+		http.DefaultClient.CloseIdleConnections()
+	}
+
+	// Wait for the mock to be listening, so tests that don't retry don't
+	// race it.
+	for range 100 {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 	return wg, stopMock
 }
 
+func newSession(t *testing.T) *fireblocks.Fireblocks {
+	t.Helper()
+	fb, err := fireblocks.NewFireblocksSession(fbBaseURL, fireblocks.WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to create Fireblocks session: %s", err)
+	}
+	return fb
+}
+
+func newProvider(t *testing.T) *service.FireblocksProvider {
+	t.Helper()
+	return &service.FireblocksProvider{Fireblocks: newSession(t)}
+}
+
+// An in-memory WalletProvider, for tests that don't care how wallets are
+// made.
+type fakeProvider struct {
+	mu       sync.Mutex
+	accounts map[string]map[string]string
+	retired  map[string]bool
+	// If set, provisioning fails with this once the account exists.
+	err error
+	// How long provisioning takes, so concurrent calls overlap.
+	delay time.Duration
+
+	inFlight    atomic.Int64
+	maxInFlight int64
+
+	// If set, the next Provision closes held once it has created everything,
+	// then waits for release before returning.
+	held, release chan struct{}
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{accounts: make(map[string]map[string]string), retired: make(map[string]bool)}
+}
+
+func (p *fakeProvider) Provision(ctx context.Context, journal *service.Journal, assets []service.Asset) error {
+	inFlight := p.inFlight.Add(1)
+	defer p.inFlight.Add(-1)
+	p.mu.Lock()
+	p.maxInFlight = max(p.maxInFlight, inFlight)
+	p.mu.Unlock()
+	time.Sleep(p.delay)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	accountId := journal.AccountID()
+	if accountId == "" {
+		accountId = fmt.Sprintf("account-%d", len(p.accounts))
+		p.accounts[accountId] = make(map[string]string)
+		if err := journal.SetAccountID(accountId); err != nil {
+			return err
+		}
+	}
+	if p.err != nil {
+		return p.err
+	}
+
+	for _, asset := range journal.Missing(assets) {
+		address := fmt.Sprintf("%s-%s", accountId, asset.ID)
+		provisioned := service.ProvisionedAsset{AssetID: asset.ID, WalletID: address, Address: address}
+		if err := journal.AddAsset(&provisioned); err != nil {
+			return err
+		}
+		p.accounts[accountId][asset.ID] = address
+	}
+
+	if held, release := p.held, p.release; held != nil {
+		p.held, p.release = nil, nil
+		close(held)
+		p.mu.Unlock()
+		<-release
+		p.mu.Lock()
+	}
+	return nil
+}
+
+func (p *fakeProvider) Supports(asset service.Asset) bool {
+	return true
+}
+
+func (p *fakeProvider) Lookup(ctx context.Context, accountId string, assets []service.Asset) (map[string][]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	account, ok := p.accounts[accountId]
+	if !ok {
+		return nil, fmt.Errorf("unknown account %s", accountId)
+	}
+	addresses := make(map[string][]string)
+	for _, asset := range assets {
+		if address, ok := account[asset.ID]; ok {
+			addresses[asset.ID] = []string{address}
+		}
+	}
+	return addresses, nil
+}
+
+func (p *fakeProvider) Retire(ctx context.Context, accountId string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retired[accountId] = true
+	return nil
+}
+
+// Wait for the pool to reach its high watermark, failing the test if it
+// takes too long.
+func waitFull(t *testing.T, pool *service.WalletPool) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := pool.WaitFull(ctx); err != nil {
+		t.Fatalf("Pool did not fill: %s", err)
+	}
+}
+
+func countPool(t *testing.T, db *gorm.DB) int64 {
+	t.Helper()
+	count, err := service.CountPoolWallets(db)
+	if err != nil {
+		t.Fatalf("Failed to count pool wallets: %s", err)
+	}
+	return count
+}
+
 func TestPopulateWalletPool(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
 	wg, stopMock := setupMock(fbBaseHost)
 	defer wg.Wait()
 	defer stopMock()
 
-	fb := fireblocks.NewFireblocksSession(fbBaseURL)
+	provider := newProvider(t)
 	threshold := 1
 
-	walletChannel := make(chan service.Wallet, threshold)
-	defer close(walletChannel)
-
 	ctx, cancelWalletPool := context.WithCancel(context.Background())
 	defer cancelWalletPool()
 
-	go service.PopulateWalletPool(walletChannel, ctx, threshold, &fb)
-	wallet := <-walletChannel
+	pool := service.NewWalletPool(db, provider, threshold, threshold)
+	go pool.Run(ctx)
+	waitFull(t, pool)
+
+	var wallet service.Wallet
+	if tx := db.Where("user_id IS NULL").Take(&wallet); tx.Error != nil {
+		t.Fatalf("Failed to get pool wallet: %s", tx.Error)
+	}
 
 	if wallet.AddressBTC == "" {
 		t.Error("Got zero-valued BTC address")
 	}
 
-	// Unpleasant. We must wait for the channel to repopulate, but we don't
-	// have a need for this in the actual code so don't implement a wait group
-	// or anything else that we could use here.
-	time.Sleep(time.Second)
-	if len(walletChannel) != threshold {
-		t.Errorf("walletChannel not at threshold")
+	if count := countPool(t, db); count != int64(threshold) {
+		t.Errorf("Pool has %d wallets, expected %d", count, threshold)
 	}
 }
 
-func TestCreateUser(t *testing.T) {
+func TestPopulateWalletPoolTopsUp(t *testing.T) {
 	db, err := setupDatabase()
 	defer os.Remove(databaseFile)
 	if err != nil {
 		t.Fatalf("Error instantiating the database: %s", err)
 	}
 
+	// Simulate wallets left over from a previous run.
+	existing := service.Wallet{AddressBTC: "tb1qexisting", AddressSOL: "existing"}
+	if tx := db.Create(&existing); tx.Error != nil {
+		t.Fatalf("Failed to create wallet: %s", tx.Error)
+	}
+
 	wg, stopMock := setupMock(fbBaseHost)
 	defer wg.Wait()
 	defer stopMock()
 
-	fb := fireblocks.NewFireblocksSession(fbBaseURL)
-
-	threshold := 1
-	walletChannel := make(chan service.Wallet, threshold)
-	defer close(walletChannel)
+	provider := newProvider(t)
+	threshold := 2
 
 	ctx, cancelWalletPool := context.WithCancel(context.Background())
 	defer cancelWalletPool()
-	go service.PopulateWalletPool(walletChannel, ctx, threshold, &fb)
 
-	data := service.Data{DB: db, Wallets: walletChannel}
+	pool := service.NewWalletPool(db, provider, threshold, threshold)
+	go pool.Run(ctx)
+	waitFull(t, pool)
+
+	var wallets []service.Wallet
+	if tx := db.Where("user_id IS NULL").Find(&wallets); tx.Error != nil {
+		t.Fatalf("Failed to get pool wallets: %s", tx.Error)
+	}
+	if len(wallets) != threshold {
+		t.Fatalf("Pool has %d wallets, expected %d", len(wallets), threshold)
+	}
+	if wallets[0].ID != existing.ID {
+		t.Errorf("Existing wallet %d not kept in the pool", existing.ID)
+	}
+}
 
-	user, err := data.CreateUser()
+func TestWalletPoolWatermarks(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
 	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	provider := newFakeProvider()
+
+	ctx, cancelWalletPool := context.WithCancel(context.Background())
+	defer cancelWalletPool()
+
+	low, high := 2, 4
+	pool := service.NewWalletPool(db, provider, low, high)
+	go pool.Run(ctx)
+	waitFull(t, pool)
+
+	data := service.Data{DB: db, Pool: pool}
+
+	// Draining down to the low watermark shouldn't trigger a refill.
+	for range high - low {
+		if _, err := data.CreateUser(context.Background()); err != nil {
+			t.Fatalf("Failed to create user: %s", err)
+		}
+	}
+	waitCtx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := pool.WaitFull(waitCtx); err == nil {
+		t.Error("Pool refilled above the low watermark")
+	}
+	if count := countPool(t, db); count != int64(low) {
+		t.Errorf("Pool has %d wallets, expected %d", count, low)
+	}
+
+	// Going below it should refill to the high watermark.
+	if _, err := data.CreateUser(context.Background()); err != nil {
 		t.Fatalf("Failed to create user: %s", err)
 	}
+	waitFull(t, pool)
+	if count := countPool(t, db); count != int64(high) {
+		t.Errorf("Pool has %d wallets, expected %d", count, high)
+	}
+}
 
-	user_prime, err := data.GetUser(user.ID)
+func TestWalletPoolWorkers(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
 	if err != nil {
-		t.Fatalf("Failed to get user: %s", err)
+		t.Fatalf("Error instantiating the database: %s", err)
 	}
 
-	if user.ID != user_prime.ID {
-		t.Errorf("User IDs %s, %s do not match", user.ID, user_prime.ID)
+	// Slow enough that the workers overlap.
+	provider := newFakeProvider()
+	provider.delay = 50 * time.Millisecond
+
+	ctx, cancelWalletPool := context.WithCancel(context.Background())
+	defer cancelWalletPool()
+
+	threshold := 10
+	pool := service.NewWalletPool(db, provider, threshold, threshold)
+	pool.Workers = 4
+	pool.ProvisionInterval = time.Millisecond
+	go pool.Run(ctx)
+	waitFull(t, pool)
+
+	if count := countPool(t, db); count != int64(threshold) {
+		t.Errorf("Pool has %d wallets, expected %d", count, threshold)
+	}
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if provider.maxInFlight > int64(pool.Workers) {
+		t.Errorf("Provisioned up to %d wallets at once, expected at most %d", provider.maxInFlight, pool.Workers)
 	}
+	if provider.maxInFlight < 2 {
+		t.Errorf("Provisioned up to %d wallets at once, expected them to be provisioned in parallel", provider.maxInFlight)
+	}
+}
 
-	if user.Wallet.ID != user_prime.Wallet.ID {
-		t.Errorf("Wallet IDs %d, %d do not match", user.Wallet.ID, user_prime.Wallet.ID)
+func TestWalletPoolResumesProvisioning(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
 	}
 
-	if user.Wallet.AddressBTC != user_prime.Wallet.AddressBTC {
-		t.Errorf("Bitcoin addresses %s, %s do not match", user.Wallet.AddressBTC, user_prime.Wallet.AddressBTC)
+	wg, stopMock := setupMock(fbBaseHost)
+	defer wg.Wait()
+	defer stopMock()
+
+	provider := newProvider(t)
+
+	// Simulate a provisioning that crashed after creating the vault account
+	// and BTC asset, but before the SOL asset.
+	fbVaultAccount, err := provider.Fireblocks.CreateVaultAccount(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Failed to create vault account: %s", err)
+	}
+	fbVaultWallet, err := provider.Fireblocks.CreateVaultAccountAsset(context.Background(), fbVaultAccount.ID, "BTC", "")
+	if err != nil {
+		t.Fatalf("Failed to create BTC asset: %s", err)
 	}
 
-	if user.Wallet.AddressSOL != user_prime.Wallet.AddressSOL {
-		t.Errorf("Solana addresses %s, %s do not match", user.Wallet.AddressSOL, user_prime.Wallet.AddressSOL)
+	journal := service.Provisioning{
+		VaultAccountID: fbVaultAccount.ID,
+		State:          service.ProvisioningPending,
+		Attempts:       1,
+		Assets:         []service.ProvisionedAsset{{AssetID: "BTC", WalletID: fbVaultWallet.ID, Address: fbVaultWallet.Address}},
+	}
+	if tx := db.Create(&journal); tx.Error != nil {
+		t.Fatalf("Failed to create journal: %s", tx.Error)
+	}
+	if tx := db.Model(&journal).UpdateColumn("updated_at", time.Now().Add(-time.Hour)); tx.Error != nil {
+		t.Fatalf("Failed to age journal: %s", tx.Error)
+	}
+
+	ctx, cancelWalletPool := context.WithCancel(context.Background())
+	defer cancelWalletPool()
+
+	pool := service.NewWalletPool(db, provider, 1, 1)
+	pool.Workers = 1
+	go pool.Run(ctx)
+	waitFull(t, pool)
+
+	var wallet service.Wallet
+	if tx := db.Where("user_id IS NULL").Take(&wallet); tx.Error != nil {
+		t.Fatalf("Failed to get pool wallet: %s", tx.Error)
+	}
+	if wallet.AddressBTC != fbVaultWallet.Address {
+		t.Errorf("Expected the journaled BTC address %s, got %s", fbVaultWallet.Address, wallet.AddressBTC)
+	}
+	if wallet.AddressSOL == "" {
+		t.Error("Got zero-valued SOL address")
+	}
+
+	if tx := db.Preload("Assets").Take(&journal, journal.ID); tx.Error != nil {
+		t.Fatalf("Failed to get journal: %s", tx.Error)
+	}
+	if journal.State != service.ProvisioningComplete {
+		t.Errorf("Journal is %s, expected %s", journal.State, service.ProvisioningComplete)
+	}
+	if journal.Attempts != 2 {
+		t.Errorf("Journal has %d attempts, expected 2", journal.Attempts)
+	}
+	if len(journal.Assets) != 2 {
+		t.Errorf("Journal has %d assets, expected 2", len(journal.Assets))
+	}
+
+	addresses, err := provider.Lookup(context.Background(), journal.VaultAccountID, service.DefaultCatalog)
+	if err != nil {
+		t.Fatalf("Failed to look up vault account: %s", err)
+	}
+	if !slices.Equal(addresses["BTC"], []string{wallet.AddressBTC}) || !slices.Equal(addresses["SOL"], []string{wallet.AddressSOL}) {
+		t.Errorf("Looked up addresses %v don't match wallet %+v", addresses, wallet)
+	}
+
+	var journals int64
+	if tx := db.Model(&service.Provisioning{}).Count(&journals); tx.Error != nil {
+		t.Fatalf("Failed to count journals: %s", tx.Error)
+	}
+	if journals != 1 {
+		t.Errorf("Found %d journals, expected only the resumed one", journals)
+	}
+}
+
+func TestWalletPoolTakenOverProvisioning(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	provider := newFakeProvider()
+	held, release := make(chan struct{}), make(chan struct{})
+	provider.held, provider.release = held, release
+
+	ctx, cancelWalletPools := context.WithCancel(context.Background())
+	defer cancelWalletPools()
+
+	slow := service.NewWalletPool(db, provider, 1, 1)
+	slow.Workers = 1
+	slow.PollInterval = 10 * time.Millisecond
+	go slow.Run(ctx)
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Provisioning never started")
+	}
+
+	// Make it look like the slow pool is gone, so another takes over its
+	// provisioning and stores the wallet.
+	if tx := db.Model(&service.Provisioning{}).Where("state = ?", service.ProvisioningPending).UpdateColumn("updated_at", time.Now().Add(-time.Hour)); tx.Error != nil {
+		t.Fatalf("Failed to age journal: %s", tx.Error)
+	}
+	other := service.NewWalletPool(db, provider, 1, 1)
+	other.Workers = 1
+	go other.Run(ctx)
+	waitFull(t, other)
+
+	// The slow pool finishing mustn't store the same wallet again.
+	close(release)
+	waitFull(t, slow)
+
+	var wallets []service.Wallet
+	if tx := db.Find(&wallets); tx.Error != nil {
+		t.Fatalf("Failed to get wallets: %s", tx.Error)
+	}
+	if len(wallets) != 1 {
+		t.Errorf("Found %d wallets, expected 1", len(wallets))
+	}
+	var journal service.Provisioning
+	if tx := db.Take(&journal); tx.Error != nil {
+		t.Fatalf("Failed to get journal: %s", tx.Error)
+	}
+	if journal.State != service.ProvisioningComplete || journal.Attempts != 2 {
+		t.Errorf("Journal is %s after %d attempts, expected %s after 2", journal.State, journal.Attempts, service.ProvisioningComplete)
+	}
+}
+
+func TestWalletPoolReplaysLostVaultAccount(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	wg, stopMock := setupMock(fbBaseHost)
+	defer wg.Wait()
+	defer stopMock()
+
+	provider := newProvider(t)
+
+	// Simulate a provisioning that created its vault account but crashed
+	// before the response reached the journal.
+	journal := service.Provisioning{State: service.ProvisioningPending, Attempts: 1}
+	if tx := db.Create(&journal); tx.Error != nil {
+		t.Fatalf("Failed to create journal: %s", tx.Error)
+	}
+	if tx := db.Model(&journal).UpdateColumn("updated_at", time.Now().Add(-time.Hour)); tx.Error != nil {
+		t.Fatalf("Failed to age journal: %s", tx.Error)
+	}
+	key := uuid.NewSHA1(uuid.MustParse(journal.IdempotencyKey), []byte("vault_account")).String()
+	fbVaultAccount, err := provider.Fireblocks.CreateVaultAccount(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Failed to create vault account: %s", err)
+	}
+
+	ctx, cancelWalletPool := context.WithCancel(context.Background())
+	defer cancelWalletPool()
+
+	pool := service.NewWalletPool(db, provider, 1, 1)
+	pool.Workers = 1
+	go pool.Run(ctx)
+	waitFull(t, pool)
+
+	if tx := db.Take(&journal, journal.ID); tx.Error != nil {
+		t.Fatalf("Failed to get journal: %s", tx.Error)
+	}
+	if journal.VaultAccountID != fbVaultAccount.ID {
+		t.Errorf("Expected the original vault account %s, got %s", fbVaultAccount.ID, journal.VaultAccountID)
+	}
+
+	page, err := provider.Fireblocks.ListVaultAccountsPaged(context.Background(), fireblocks.PageRequest{Limit: 10})
+	if err != nil {
+		t.Fatalf("Failed to list vault accounts: %s", err)
+	}
+	if len(page.Accounts) != 1 {
+		t.Errorf("Found %d vault accounts, expected only the original", len(page.Accounts))
+	}
+}
+
+func TestWalletPoolRetiresAbandoned(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	provider := newFakeProvider()
+	provider.err = errors.New("out of addresses")
+
+	ctx, cancelWalletPool := context.WithCancel(context.Background())
+	defer cancelWalletPool()
+
+	pool := service.NewWalletPool(db, provider, 1, 1)
+	pool.MaxProvisioningAttempts = 1
+	go pool.Run(ctx)
+
+	var journal service.Provisioning
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var journals []service.Provisioning
+		if tx := db.Where("state = ?", service.ProvisioningAbandoned).Limit(1).Find(&journals); tx.Error != nil {
+			t.Fatalf("Failed to get journals: %s", tx.Error)
+		}
+		if len(journals) > 0 {
+			journal = journals[0]
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("No provisioning was abandoned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancelWalletPool()
+
+	if journal.LastError != provider.err.Error() {
+		t.Errorf("Expected last error %q, got %q", provider.err, journal.LastError)
+	}
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if !provider.retired[journal.VaultAccountID] {
+		t.Errorf("Abandoned account %s wasn't retired", journal.VaultAccountID)
+	}
+	if count := countPool(t, db); count != 0 {
+		t.Errorf("Pool has %d wallets, expected none", count)
+	}
+}
+
+// Account keys and addresses from the BIP84 and BIP86 test vectors.
+const (
+	bip84AccountKey = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+	bip86AccountKey = "xpub6BgBgsespWvERF3LHQu6CnqdvfEvtMcQjYrcRzx53QJjSxarj2afYWcLteoGVky7D3UKDP9QyrLprQ3VCECoY49yfdDEHGCtMMj92pReUsQ"
+)
+
+var bip84Addresses = []string{
+	"bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu",
+	"bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g",
+}
+
+func TestHDProvider(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	if _, err := service.NewHDProvider(db, bip84AccountKey, "testnet", false); err == nil {
+		t.Error("Accepted a mainnet key for testnet")
+	}
+	if _, err := service.NewHDProvider(db, bip84AccountKey, "signet", false); err == nil {
+		t.Error("Accepted an unknown network")
+	}
+	if _, err := service.NewHDProvider(db, bip84AccountKey, "mainnet", true); err == nil {
+		t.Error("Accepted a zpub for Taproot")
+	}
+
+	provider, err := service.NewHDProvider(db, bip84AccountKey, "mainnet", false)
+	if err != nil {
+		t.Fatalf("Failed to create HD provider: %s", err)
+	}
+
+	fill := func(provider service.WalletProvider, size int) {
+		t.Helper()
+		ctx, cancelWalletPool := context.WithCancel(context.Background())
+		defer cancelWalletPool()
+		pool := service.NewWalletPool(db, provider, size, size)
+		pool.Workers = 3
+		go pool.Run(ctx)
+		waitFull(t, pool)
+	}
+	checkIndexes := func(count int) {
+		t.Helper()
+		var wallets []service.Wallet
+		if tx := db.Order("derivation_index").Find(&wallets); tx.Error != nil {
+			t.Fatalf("Failed to get wallets: %s", tx.Error)
+		}
+		if len(wallets) != count {
+			t.Fatalf("Found %d wallets, expected %d", len(wallets), count)
+		}
+		for i, wallet := range wallets {
+			if wallet.DerivationIndex == nil || *wallet.DerivationIndex != uint32(i) {
+				t.Fatalf("Wallet %d has derivation index %v, expected %d", wallet.ID, wallet.DerivationIndex, i)
+			}
+			if wallet.AddressSOL != "" {
+				t.Errorf("Wallet %d has a SOL address %s", wallet.ID, wallet.AddressSOL)
+			}
+			if i < len(bip84Addresses) && wallet.AddressBTC != bip84Addresses[i] {
+				t.Errorf("Wallet %d has address %s, expected %s", wallet.ID, wallet.AddressBTC, bip84Addresses[i])
+			}
+		}
+	}
+
+	fill(provider, 6)
+	checkIndexes(6)
+
+	// Indexes carry on where they left off, even for a new provider.
+	provider, err = service.NewHDProvider(db, bip84AccountKey, "mainnet", false)
+	if err != nil {
+		t.Fatalf("Failed to create HD provider: %s", err)
+	}
+	fill(provider, 7)
+	checkIndexes(7)
+
+	taproot, err := service.NewHDProvider(db, bip86AccountKey, "mainnet", true)
+	if err != nil {
+		t.Fatalf("Failed to create HD provider: %s", err)
+	}
+	addresses, err := taproot.Lookup(context.Background(), "0", service.DefaultCatalog)
+	if err != nil {
+		t.Fatalf("Failed to look up address: %s", err)
+	}
+	expected := map[string][]string{"BTC": {"bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr"}}
+	if !maps.EqualFunc(addresses, expected, slices.Equal) {
+		t.Errorf("Looked up %v, expected %v", addresses, expected)
+	}
+
+	// Two Bitcoin assets would be given the same address.
+	catalog := append(slices.Clone(service.DefaultCatalog),
+		service.Asset{ID: "BTC_LN", Chain: "bitcoin", AddressFormat: service.FormatBech32, Enabled: true})
+	if err := taproot.CheckAssets(catalog); err == nil {
+		t.Error("Accepted a catalog with two Bitcoin assets")
+	}
+	if _, err := taproot.Lookup(context.Background(), "0", catalog); err == nil {
+		t.Error("Looked up two Bitcoin assets at the same index")
+	}
+}
+
+func TestAssetCatalog(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	wg, stopMock := setupMock(fbBaseHost)
+	defer wg.Wait()
+	defer stopMock()
+
+	dir := t.TempDir()
+	writeCatalog := func(name, contents string) string {
+		t.Helper()
+		path := dir + "/" + name
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatalf("Failed to write catalog: %s", err)
+		}
+		return path
+	}
+
+	invalid := writeCatalog("invalid.json", `[
+		{"id": "BTC", "chain": "bitcoin", "address_format": "bech32", "enabled": true},
+		{"id": "BTC", "chain": "bitcoin", "address_format": "bech32", "enabled": true},
+		{"id": "DOGE", "chain": "dogecoin", "address_format": "base32", "enabled": true}
+	]`)
+	if _, err := service.LoadCatalog(invalid); err == nil {
+		t.Error("Loaded a catalog with a duplicate asset and an unknown address format")
+	}
+
+	catalog, err := service.LoadCatalog(writeCatalog("catalog.json", `[
+		{"id": "BTC", "chain": "bitcoin", "address_format": "bech32", "enabled": true},
+		{"id": "SOL", "chain": "solana", "address_format": "base58", "enabled": false},
+		{"id": "ETH", "fireblocks_id": "ETH_TEST5", "chain": "ethereum", "address_format": "hex", "enabled": true},
+		{"id": "XRP", "chain": "ripple", "address_format": "base58", "needs_tag": true, "enabled": true}
+	]`))
+	if err != nil {
+		t.Fatalf("Failed to load catalog: %s", err)
+	}
+
+	ctx, cancelWalletPool := context.WithCancel(context.Background())
+	defer cancelWalletPool()
+
+	pool := service.NewWalletPool(db, newProvider(t), 1, 1)
+	pool.Assets = catalog
+	go pool.Run(ctx)
+	waitFull(t, pool)
+	cancelWalletPool()
+
+	data := service.Data{DB: db, Pool: pool}
+	user, err := data.CreateUser(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create user: %s", err)
+	}
+	user_prime, err := data.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get user: %s", err)
+	}
+
+	var assets []string
+	for _, address := range user_prime.Wallet.Addresses {
+		assets = append(assets, address.AssetID)
+	}
+	if !slices.Equal(assets, []string{"BTC", "ETH", "XRP"}) {
+		t.Fatalf("Wallet has addresses for %v, expected BTC, ETH and XRP", assets)
+	}
+	btc, _ := user_prime.Wallet.Address("BTC")
+	if btc.Address != user_prime.Wallet.AddressBTC {
+		t.Errorf("BTC address %s doesn't match legacy column %s", btc.Address, user_prime.Wallet.AddressBTC)
+	}
+	if btc.LegacyAddress == "" {
+		t.Error("BTC address has no legacy address")
+	}
+	if user_prime.Wallet.AddressSOL != "" {
+		t.Errorf("Wallet has a SOL address %s, but SOL is disabled", user_prime.Wallet.AddressSOL)
+	}
+	eth, _ := user_prime.Wallet.Address("ETH")
+	if !strings.HasPrefix(eth.Address, "0x") || eth.Format != service.FormatHex {
+		t.Errorf("Expected a hex ETH address, got %+v", eth)
+	}
+	if eth.VaultAccountID == "" || eth.VaultWalletID == "" {
+		t.Errorf("ETH address %+v doesn't say which vault it's in", eth)
+	}
+	if user_prime.Wallet.VaultAccountID != eth.VaultAccountID {
+		t.Errorf("Wallet is in vault account %q, its ETH address in %s", user_prime.Wallet.VaultAccountID, eth.VaultAccountID)
+	}
+	if xrp, _ := user_prime.Wallet.Address("XRP"); xrp.Tag == "" {
+		t.Error("XRP address has no tag")
+	}
+}
+
+func TestProvisionETH(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	wg, stopMock := setupMock(fbBaseHost)
+	defer wg.Wait()
+	defer stopMock()
+
+	catalog := service.Catalog{
+		{ID: "BTC", FireblocksID: "BTC", Chain: "bitcoin", AddressFormat: service.FormatBech32, Enabled: true},
+		{ID: "ETH", FireblocksID: "ETH", Chain: "ethereum", AddressFormat: service.FormatHex, Enabled: true},
+	}
+
+	ctx, cancelWalletPool := context.WithCancel(context.Background())
+	defer cancelWalletPool()
+
+	provider := newProvider(t)
+	pool := service.NewWalletPool(db, provider, 1, 1)
+	pool.Assets = catalog
+	go pool.Run(ctx)
+	waitFull(t, pool)
+	cancelWalletPool()
+
+	var wallet service.Wallet
+	if tx := db.Preload("Addresses").Take(&wallet); tx.Error != nil {
+		t.Fatalf("Failed to get wallet: %s", tx.Error)
+	}
+	if eth, ok := wallet.Address("ETH"); !ok || !strings.HasPrefix(eth.Address, "0x") {
+		t.Fatalf("Expected an ETH address, got %+v", wallet.Addresses)
+	}
+
+	reconciler := service.Reconciler{DB: db, Provider: provider, Assets: catalog}
+	report, err := reconciler.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %s", err)
+	}
+	if len(report.Drift) != 0 {
+		t.Errorf("Expected no drift, got %+v", report.Drift)
+	}
+}
+
+func TestDatabaseConfigFromEnv(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://address-manager@localhost/address_manager")
+	t.Setenv("DATABASE_MAX_OPEN_CONNS", "50")
+	t.Setenv("DATABASE_CONN_MAX_LIFETIME", "1h")
+	config, err := service.DatabaseConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Failed to configure database: %s", err)
+	}
+	if !config.IsPostgres() {
+		t.Errorf("Expected %s to be PostgreSQL", config.DSN)
+	}
+	if config.MaxOpenConns != 50 || config.MaxIdleConns != 10 || config.ConnMaxLifetime != time.Hour {
+		t.Errorf("Unexpected pool settings %+v", config)
+	}
+
+	t.Setenv("DATABASE_URL", "other.db?_busy_timeout=5000")
+	t.Setenv("DATABASE_CONN_MAX_LIFETIME", "forever")
+	if _, err := service.DatabaseConfigFromEnv(); err == nil {
+		t.Error("Expected an invalid lifetime to fail")
+	}
+	t.Setenv("DATABASE_CONN_MAX_LIFETIME", "")
+	if config, err := service.DatabaseConfigFromEnv(); err != nil || config.IsPostgres() {
+		t.Errorf("Expected %s to be SQLite: %v", config.DSN, err)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	db, err := openDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+	migrator, err := service.NewMigrator(db)
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %s", err)
+	}
+	if len(migrator.Migrations) == 0 {
+		t.Fatalf("No migrations for %s", testDatabase)
+	}
+	latest := migrator.Migrations[len(migrator.Migrations)-1]
+
+	if err := migrator.Check(); !errors.Is(err, service.ErrSchemaBehind) {
+		t.Fatalf("Expected a new database to be behind, got %v", err)
+	}
+	if count, err := migrator.Up(); err != nil || count != len(migrator.Migrations) {
+		t.Fatalf("Applied %d of %d migrations: %v", count, len(migrator.Migrations), err)
+	}
+	if err := migrator.Check(); err != nil {
+		t.Fatalf("Schema isn't current after migrating: %s", err)
+	}
+	if count, err := migrator.Up(); err != nil || count != 0 {
+		t.Fatalf("Applied %d migrations again: %v", count, err)
+	}
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatalf("Failed to get status: %s", err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt.IsZero() || status.Modified || status.Unknown {
+			t.Errorf("Unexpected status %+v", status)
+		}
+	}
+
+	// Everything can be rolled back, and applied again.
+	if count, err := migrator.Down(len(migrator.Migrations)); err != nil || count != len(migrator.Migrations) {
+		t.Fatalf("Rolled back %d of %d migrations: %v", count, len(migrator.Migrations), err)
+	}
+	if db.Migrator().HasTable(&service.Wallet{}) {
+		t.Error("Wallets table survived rolling back")
+	}
+	if err := migrator.Check(); !errors.Is(err, service.ErrSchemaBehind) {
+		t.Fatalf("Expected rolled back database to be behind, got %v", err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatalf("Failed to migrate again: %s", err)
+	}
+
+	// An applied migration that's since been edited.
+	if tx := db.Exec("UPDATE schema_migrations SET checksum = 'edited' WHERE version = ?", latest.Version); tx.Error != nil {
+		t.Fatalf("Failed to edit checksum: %s", tx.Error)
+	}
+	if err := migrator.Check(); !errors.Is(err, service.ErrSchemaModified) {
+		t.Errorf("Expected modified migration, got %v", err)
+	}
+	if _, err := migrator.Up(); !errors.Is(err, service.ErrSchemaModified) {
+		t.Errorf("Expected migrating to refuse a modified migration, got %v", err)
+	}
+	if tx := db.Exec("UPDATE schema_migrations SET checksum = ? WHERE version = ?", latest.Checksum(), latest.Version); tx.Error != nil {
+		t.Fatalf("Failed to restore checksum: %s", tx.Error)
+	}
+
+	// And one from a newer build.
+	newer := service.SchemaMigration{Version: latest.Version + 1, Name: "newer", Checksum: "newer", AppliedAt: time.Now()}
+	if tx := db.Create(&newer); tx.Error != nil {
+		t.Fatalf("Failed to record newer migration: %s", tx.Error)
+	}
+	if err := migrator.Check(); !errors.Is(err, service.ErrSchemaAhead) {
+		t.Errorf("Expected schema to be ahead, got %v", err)
+	}
+	if _, err := migrator.Down(1); !errors.Is(err, service.ErrSchemaAhead) {
+		t.Errorf("Expected rolling back an unknown migration to fail, got %v", err)
+	}
+}
+
+// The schema AutoMigrate created for the last release before we had
+// migrations.
+const baselineSchema = `
+CREATE TABLE "users" ("id" text,"created_at" datetime,"updated_at" datetime,"deleted_at" datetime,PRIMARY KEY ("id"));
+CREATE INDEX "idx_users_deleted_at" ON "users"("deleted_at");
+CREATE TABLE "wallets" ("id" integer PRIMARY KEY AUTOINCREMENT,"created_at" datetime,"updated_at" datetime,"deleted_at" datetime,"address_btc" text,"address_sol" text,"user_id" text,CONSTRAINT "fk_users_wallet" FOREIGN KEY ("user_id") REFERENCES "users"("id"));
+CREATE INDEX "idx_wallets_deleted_at" ON "wallets"("deleted_at");
+`
+
+func TestMigrationsAdoptAutoMigratedSchema(t *testing.T) {
+	if testDatabase != "sqlite" {
+		t.Skip("Only SQLite databases were created by AutoMigrate")
+	}
+	db, err := openDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+	if err := db.Exec(baselineSchema).Error; err != nil {
+		t.Fatalf("Failed to create baseline schema: %s", err)
+	}
+	userId := uuid.New()
+	if err := db.Exec("INSERT INTO users (id, created_at, updated_at) VALUES (?, ?, ?)", userId, time.Now(), time.Now()).Error; err != nil {
+		t.Fatalf("Failed to create user: %s", err)
+	}
+	err = db.Exec("INSERT INTO wallets (created_at, updated_at, address_btc, address_sol, user_id) VALUES (?, ?, 'tb1qexisting', 'existing', ?)", time.Now(), time.Now(), userId).Error
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %s", err)
+	}
+
+	migrator, err := service.NewMigrator(db)
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %s", err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatalf("Failed to migrate the baseline schema: %s", err)
+	}
+	if err := migrator.Check(); err != nil {
+		t.Errorf("Migrated schema doesn't check out: %s", err)
+	}
+	if migrated, err := service.MigrateAddresses(db, service.DefaultCatalog); err != nil || migrated != 2 {
+		t.Errorf("Migrated %d addresses (%v), expected 2", migrated, err)
+	}
+
+	data := service.Data{DB: db}
+	user, err := data.GetUser(userId)
+	if err != nil {
+		t.Fatalf("Lost existing user: %s", err)
+	}
+	if user.Wallet.AddressBTC != "tb1qexisting" {
+		t.Errorf("Lost existing wallet, got %+v", user.Wallet)
+	}
+	if owner, err := data.LookupAddress("TB1QEXISTING", ""); err != nil || owner.User == nil || owner.User.ID != userId {
+		t.Errorf("Existing address wasn't migrated: %v", err)
+	}
+
+	// The rest of the schema is usable too.
+	wallet := service.Wallet{VaultAccountID: "42", Addresses: []service.Address{{AssetID: "BTC", Address: "tb1qnew", Format: service.FormatBech32}}}
+	if tx := db.Create(&wallet); tx.Error != nil {
+		t.Errorf("Failed to create wallet: %s", tx.Error)
+	}
+}
+
+func TestLookupAddress(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	// The first is claimed by a user, the second stays in the pool. They
+	// share an XRP address, told apart by tag, and the first uses its ETH
+	// address for a token too.
+	wallets := []service.Wallet{
+		{Addresses: []service.Address{
+			{AssetID: "BTC", Address: "tb1qowned", LegacyAddress: "mOwnedLegacy", Format: service.FormatBech32},
+			{AssetID: "SOL", Address: "OwnedSoL", Format: service.FormatBase58},
+			{AssetID: "ETH", Address: "0xOwnedEth", Format: service.FormatHex},
+			{AssetID: "USDC", Address: "0xOwnedEth", Format: service.FormatHex},
+			{AssetID: "XRP", Address: "rShared", Tag: "1", Format: service.FormatBase58},
+		}},
+		{Addresses: []service.Address{
+			{AssetID: "BTC", Address: "tb1qpooled", Format: service.FormatBech32},
+			{AssetID: "XRP", Address: "rShared", Tag: "2", Format: service.FormatBase58},
+		}},
+	}
+	for i := range wallets {
+		if tx := db.Create(&wallets[i]); tx.Error != nil {
+			t.Fatalf("Failed to create wallet: %s", tx.Error)
+		}
+	}
+	data := service.Data{DB: db}
+	user, err := data.CreateUser(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create user: %s", err)
+	}
+
+	for _, c := range []struct {
+		address, tag string
+		assetIds     []string
+	}{
+		{"tb1qowned", "", []string{"BTC"}},
+		{"TB1QOWNED", "", []string{"BTC"}},
+		{"mOwnedLegacy", "", []string{"BTC"}},
+		{"OwnedSoL", "", []string{"SOL"}},
+		{"0xownedeth", "", []string{"ETH", "USDC"}},
+		{"0XOWNEDETH", "", []string{"ETH", "USDC"}},
+		{"rShared", "1", []string{"XRP"}},
+	} {
+		owner, err := data.LookupAddress(c.address, c.tag)
+		if err != nil {
+			t.Errorf("Failed to look up %s: %s", c.address, err)
+			continue
+		}
+		var assetIds []string
+		for _, address := range owner.Addresses {
+			assetIds = append(assetIds, address.AssetID)
+		}
+		if !slices.Equal(assetIds, c.assetIds) || owner.User == nil || owner.User.ID != user.ID {
+			t.Errorf("Looked up %s as %v owned by %v, expected %v owned by %s", c.address, assetIds, owner.User, c.assetIds, user.ID)
+		}
+	}
+
+	// Base58 is case sensitive, other encodings are only found as they were
+	// given to us, and tagged addresses need their tag.
+	for _, address := range []string{"ownedsol", "mownedlegacy", "tb1qunknown", "rShared", ""} {
+		if _, err := data.LookupAddress(address, ""); !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Errorf("Expected %s not to be found, got %v", address, err)
+		}
+	}
+
+	owner, err := data.LookupAddress("rShared", "2")
+	if err != nil {
+		t.Fatalf("Failed to look up pooled address: %s", err)
+	}
+	if owner.User != nil || owner.WalletID != wallets[1].ID {
+		t.Errorf("Expected pooled address to be in wallet %d without a user, got %+v", wallets[1].ID, owner)
+	}
+
+	// An address can't be given out twice, however it's written.
+	for _, duplicate := range []service.Address{
+		{WalletID: wallets[1].ID, AssetID: "ETH", Address: "0xOWNEDETH", Format: service.FormatHex},
+		{WalletID: wallets[1].ID, AssetID: "XRP_TEST", Address: "rShared", Tag: "1", Format: service.FormatBase58},
+	} {
+		if tx := db.Create(&duplicate); !errors.Is(tx.Error, service.ErrAddressOwned) {
+			t.Errorf("Stored %s, which another wallet already has: %v", duplicate.Address, tx.Error)
+		}
+	}
+
+	// Nor by skipping our hooks, which leaves it unnormalized, or writing it
+	// by hand.
+	duplicate := service.Address{WalletID: wallets[1].ID, AssetID: "ETH", Address: "0xOWNEDETH", Format: service.FormatHex}
+	if tx := db.Session(&gorm.Session{SkipHooks: true}).Create(&duplicate); tx.Error == nil {
+		t.Errorf("Stored %s without normalizing it", duplicate.Address)
+	}
+	err = db.Exec("INSERT INTO addresses (wallet_id, asset_id, address, normalized_address, format, tag) VALUES (?, 'ETH', '0xOWNEDETH', '0xownedeth', 'hex', '')", wallets[1].ID).Error
+	if err == nil {
+		t.Error("Stored an address by hand which another wallet already has")
+	}
+	// But a wallet can use its own address for another asset.
+	err = db.Exec("INSERT INTO addresses (wallet_id, asset_id, address, normalized_address, format, tag) VALUES (?, 'DAI', '0XOWNEDETH', '0xownedeth', 'hex', '')", wallets[0].ID).Error
+	if err != nil {
+		t.Errorf("Failed to store a wallet's own address for another asset: %s", err)
+	}
+	if owner, err := data.LookupAddress("0xownedeth", ""); err != nil || len(owner.Addresses) != 3 {
+		t.Errorf("Expected an address stored by hand to be found, got %+v, %v", owner, err)
+	}
+}
+
+func TestNormalizeAddresses(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	// Addresses stored before they were normalized.
+	migrator, err := service.NewMigrator(db)
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %s", err)
+	}
+	if _, err := migrator.Down(2); err != nil {
+		t.Fatalf("Failed to roll back: %s", err)
+	}
+	wallets := []service.Wallet{{}, {}}
+	for i := range wallets {
+		if tx := db.Omit("Addresses").Create(&wallets[i]); tx.Error != nil {
+			t.Fatalf("Failed to create wallet: %s", tx.Error)
+		}
+	}
+	for _, address := range []struct{ assetId, address, format string }{
+		{"BTC", "TB1QOLD", "bech32"},
+		{"SOL", "OldSoL", "base58"},
+	} {
+		err := db.Exec("INSERT INTO addresses (wallet_id, asset_id, address, format) VALUES (?, ?, ?, ?)",
+			wallets[0].ID, address.assetId, address.address, address.format).Error
+		if err != nil {
+			t.Fatalf("Failed to create address: %s", err)
+		}
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatalf("Failed to migrate: %s", err)
+	}
+
+	if normalized, err := service.NormalizeAddresses(db); err != nil || normalized != 2 {
+		t.Errorf("Normalized %d addresses (%v), expected 2", normalized, err)
+	}
+	if normalized, err := service.NormalizeAddresses(db); err != nil || normalized != 0 {
+		t.Errorf("Normalizing again normalized %d addresses (%v), expected none", normalized, err)
+	}
+	data := service.Data{DB: db}
+	for _, address := range []string{"tb1qold", "OldSoL"} {
+		if owner, err := data.LookupAddress(address, ""); err != nil || owner.WalletID != wallets[0].ID {
+			t.Errorf("Expected %s to be found in wallet %d, got %+v, %v", address, wallets[0].ID, owner, err)
+		}
+	}
+
+	// Normalizing claims them, so one another wallet already has is
+	// refused.
+	if _, err := migrator.Down(2); err != nil {
+		t.Fatalf("Failed to roll back: %s", err)
+	}
+	if err := db.Exec("INSERT INTO addresses (wallet_id, asset_id, address, format) VALUES (?, 'BTC', 'tb1qold', 'bech32')", wallets[1].ID).Error; err != nil {
+		t.Fatalf("Failed to create address: %s", err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatalf("Failed to migrate: %s", err)
+	}
+	if _, err := service.NormalizeAddresses(db); !errors.Is(err, service.ErrAddressOwned) {
+		t.Errorf("Expected normalizing an address another wallet has to fail with %s, got %v", service.ErrAddressOwned, err)
+	}
+}
+
+func TestGetAddressHandler(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	wallet := service.Wallet{Addresses: []service.Address{{AssetID: "BTC", Address: "tb1qowned", Format: service.FormatBech32}}}
+	if tx := db.Create(&wallet); tx.Error != nil {
+		t.Fatalf("Failed to create wallet: %s", tx.Error)
+	}
+	data := service.Data{DB: db}
+	user, err := data.CreateUser(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create user: %s", err)
+	}
+	handler := data.Handler()
+
+	for _, address := range []string{"tb1qowned", "TB1QOWNED"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/address/"+address, nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Got status %d for %s, expected %d", recorder.Code, address, http.StatusOK)
+			continue
+		}
+		var owner service.AddressOwner
+		if err := json.Unmarshal(recorder.Body.Bytes(), &owner); err != nil {
+			t.Fatalf("Failed to decode owner: %s", err)
+		}
+		if owner.User == nil || owner.User.ID != user.ID || owner.WalletID != wallet.ID {
+			t.Errorf("Looked up %s as owned by %+v, expected %s", address, owner, user.ID)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/address/tb1qunknown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Got status %d for an unknown address, expected %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestMigrateAddresses(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	// Wallets from before the address table, one of them journaled, and
+	// one with a JSON column of addresses, from before that.
+	if err := db.Exec("ALTER TABLE wallets ADD COLUMN addresses text").Error; err != nil {
+		t.Fatalf("Failed to add legacy column: %s", err)
+	}
+	journaled := service.Wallet{AddressBTC: "tb1qjournaled", AddressSOL: "journaled"}
+	tagged := service.Wallet{AddressBTC: "tb1qtagged"}
+	for _, wallet := range []*service.Wallet{&journaled, &tagged} {
+		if tx := db.Omit("Addresses").Create(wallet); tx.Error != nil {
+			t.Fatalf("Failed to create wallet: %s", tx.Error)
+		}
+	}
+	if tx := db.Exec(`UPDATE wallets SET addresses = '{"XRP":{"Address":"rtagged","Tag":"7"}}' WHERE id = ?`, tagged.ID); tx.Error != nil {
+		t.Fatalf("Failed to set legacy addresses: %s", tx.Error)
+	}
+	journal := service.Provisioning{
+		VaultAccountID: "42",
+		State:          service.ProvisioningComplete,
+		Assets:         []service.ProvisionedAsset{{AssetID: "BTC", WalletID: "BTC-42", Address: "tb1qjournaled"}},
+	}
+	if tx := db.Create(&journal); tx.Error != nil {
+		t.Fatalf("Failed to create journal: %s", tx.Error)
+	}
+
+	// And one that already has its addresses in the table.
+	current := service.Wallet{AddressBTC: "tb1qcurrent", Addresses: []service.Address{{AssetID: "BTC", Address: "tb1qcurrent"}}}
+	if tx := db.Create(&current); tx.Error != nil {
+		t.Fatalf("Failed to create wallet: %s", tx.Error)
+	}
+
+	migrated, err := service.MigrateAddresses(db, service.DefaultCatalog)
+	if err != nil {
+		t.Fatalf("Failed to migrate addresses: %s", err)
+	}
+	if migrated != 4 {
+		t.Errorf("Migrated %d addresses, expected 4", migrated)
+	}
+	if migrated, err := service.MigrateAddresses(db, service.DefaultCatalog); err != nil || migrated != 0 {
+		t.Errorf("Migrating again moved %d addresses (%v), expected none", migrated, err)
+	}
+	if migrated, err := service.MigrateVaultAccountIDs(db); err != nil || migrated != 1 {
+		t.Errorf("Recorded vault accounts on %d wallets (%v), expected 1", migrated, err)
+	}
+
+	var wallets []service.Wallet
+	if tx := db.Preload("Addresses").Order("id").Find(&wallets); tx.Error != nil {
+		t.Fatalf("Failed to get wallets: %s", tx.Error)
+	}
+	btc, _ := wallets[0].Address("BTC")
+	if btc.Address != "tb1qjournaled" || btc.Format != service.FormatBech32 || btc.VaultAccountID != "42" || btc.VaultWalletID != "BTC-42" {
+		t.Errorf("Unexpected migrated address %+v", btc)
+	}
+	if wallets[0].VaultAccountID != "42" {
+		t.Errorf("Wallet has vault account %q, expected 42", wallets[0].VaultAccountID)
+	}
+	if sol, ok := wallets[0].Address("SOL"); !ok || sol.Address != "journaled" || sol.VaultAccountID != "" {
+		t.Errorf("Unexpected migrated address %+v", sol)
+	}
+	if xrp, _ := wallets[1].Address("XRP"); xrp.Address != "rtagged" || xrp.Tag != "7" {
+		t.Errorf("Unexpected migrated address %+v", xrp)
+	}
+	if len(wallets[1].Addresses) != 2 || len(wallets[2].Addresses) != 1 {
+		t.Errorf("Wallets have %d and %d addresses, expected 2 and 1", len(wallets[1].Addresses), len(wallets[2].Addresses))
+	}
+}
+
+// Count the drift in a report by kind.
+func countDrift(report *service.DriftReport) map[service.DriftKind]int {
+	counts := make(map[service.DriftKind]int)
+	for _, drift := range report.Drift {
+		counts[drift.Kind]++
+	}
+	return counts
+}
+
+// Records the method and path of every request it sends.
+type requestRecorder struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (r *requestRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	r.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (r *requestRecorder) Requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.requests)
+}
+
+// Getting a single vault account.
+var vaultAccountPath = regexp.MustCompile(`^GET /v1/vault/accounts/[^/]+$`)
+
+func TestReconcile(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	wg, stopMock := setupMock(fbBaseHost)
+	defer wg.Wait()
+	defer stopMock()
+
+	provider := newProvider(t)
+
+	ctx, cancelWalletPool := context.WithCancel(context.Background())
+	pool := service.NewWalletPool(db, provider, 2, 2)
+	go pool.Run(ctx)
+	waitFull(t, pool)
+	cancelWalletPool()
+
+	// A vault account we don't know about, with only one of our assets.
+	fbVaultAccount, err := provider.Fireblocks.CreateVaultAccount(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Failed to create vault account: %s", err)
+	}
+	if _, err := provider.Fireblocks.CreateVaultAccountAsset(context.Background(), fbVaultAccount.ID, "BTC", ""); err != nil {
+		t.Fatalf("Failed to create BTC asset: %s", err)
+	}
+
+	// A wallet whose address has drifted.
+	var wallet service.Wallet
+	if tx := db.Take(&wallet); tx.Error != nil {
+		t.Fatalf("Failed to get wallet: %s", tx.Error)
+	}
+	if tx := db.Model(&service.Address{}).Where("wallet_id = ? AND asset_id = ?", wallet.ID, "SOL").Update("address", "bogus"); tx.Error != nil {
+		t.Fatalf("Failed to update wallet: %s", tx.Error)
+	}
+
+	// And one whose address is written in another case, which isn't drift.
+	if tx := db.Model(&service.Address{}).Where("wallet_id != ? AND asset_id = ?", wallet.ID, "BTC").Update("address", gorm.Expr("upper(address)")); tx.Error != nil || tx.RowsAffected != 1 {
+		t.Fatalf("Failed to update wallet: %v", tx.Error)
+	}
+
+	// A wallet with no vault account at all.
+	if tx := db.Create(&service.Wallet{AddressBTC: "tb1qmissing", AddressSOL: "missing"}); tx.Error != nil {
+		t.Fatalf("Failed to create wallet: %s", tx.Error)
+	}
+
+	// Listing vault accounts gives us their assets, so none should be
+	// looked up on its own.
+	recorder := &requestRecorder{}
+	fb, err := fireblocks.NewFireblocksSession(fbBaseURL, fireblocks.WithHTTPClient(&http.Client{Transport: recorder}))
+	if err != nil {
+		t.Fatalf("Failed to create Fireblocks session: %s", err)
+	}
+	reconciler := service.Reconciler{DB: db, Provider: &service.FireblocksProvider{Fireblocks: fb}, PageSize: 1}
+	report, err := reconciler.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %s", err)
+	}
+	for _, request := range recorder.Requests() {
+		if vaultAccountPath.MatchString(request) {
+			t.Errorf("Looked up a vault account while reconciling: %s", request)
+		}
+	}
+	if report.VaultAccounts != 3 {
+		t.Errorf("Saw %d vault accounts, expected 3", report.VaultAccounts)
+	}
+	expected := map[service.DriftKind]int{
+		service.DriftOrphanedVault:   1,
+		service.DriftAddressMismatch: 1,
+		service.DriftMissingVault:    1,
+	}
+	if counts := countDrift(report); !maps.Equal(counts, expected) {
+		t.Errorf("Got drift %v, expected %v", counts, expected)
+	}
+
+	// A provisioning that hasn't recorded its vault account yet could be
+	// the one that created the orphan, so it mustn't be adopted.
+	inFlight := service.Provisioning{State: service.ProvisioningPending}
+	if tx := db.Create(&inFlight); tx.Error != nil {
+		t.Fatalf("Failed to create journal: %s", tx.Error)
+	}
+	before := countPool(t, db)
+	reconciler.Adopt = true
+	report, err = reconciler.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %s", err)
+	}
+	for _, drift := range report.Drift {
+		if drift.Adopted {
+			t.Errorf("Adopted vault account %s while a provisioning was in flight", drift.VaultAccountID)
+		}
+	}
+	if after := countPool(t, db); after != before {
+		t.Errorf("Pool has %d wallets, expected %d", after, before)
+	}
+	if tx := db.Delete(&inFlight); tx.Error != nil {
+		t.Fatalf("Failed to delete journal: %s", tx.Error)
+	}
+
+	report, err = reconciler.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %s", err)
+	}
+	for _, drift := range report.Drift {
+		if drift.Kind == service.DriftOrphanedVault && !drift.Adopted {
+			t.Errorf("Orphaned vault account %s not adopted", drift.VaultAccountID)
+		}
+	}
+	if after := countPool(t, db); after != before+1 {
+		t.Errorf("Pool has %d wallets, expected %d after adoption", after, before+1)
+	}
+
+	report, err = reconciler.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %s", err)
+	}
+	if n := countDrift(report)[service.DriftOrphanedVault]; n != 0 {
+		t.Errorf("Found %d orphaned vault accounts after adoption", n)
+	}
+}
+
+func TestPoolSizer(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	now := time.Now()
+	sizer := service.PoolSizer{DB: db, Min: 4, Max: 100, Window: 10 * time.Minute, Horizon: 5 * time.Minute}
+
+	// With no demand, we sit at the minimum.
+	target, err := sizer.Target(now)
+	if err != nil {
+		t.Fatalf("Failed to compute target: %s", err)
+	}
+	if target.HighWatermark != sizer.Min || target.LowWatermark != sizer.Min/2 {
+		t.Errorf("Got watermarks %d-%d, expected %d-%d", target.LowWatermark, target.HighWatermark, sizer.Min/2, sizer.Min)
+	}
+
+	// 60 sign-ups in the window is 0.1 per second, and one taking 10
+	// seconds to provision.
+	for i := range 60 {
+		user := service.User{CreatedAt: now.Add(-time.Duration(i) * time.Second)}
+		if tx := db.Create(&user); tx.Error != nil {
+			t.Fatalf("Failed to create user: %s", tx.Error)
+		}
+	}
+	// Outside the window, so shouldn't count.
+	if tx := db.Create(&service.User{CreatedAt: now.Add(-time.Hour)}); tx.Error != nil {
+		t.Fatalf("Failed to create user: %s", tx.Error)
+	}
+	journal := service.Provisioning{State: service.ProvisioningComplete}
+	journal.CreatedAt = now.Add(-20 * time.Second)
+	journal.UpdatedAt = now.Add(-10 * time.Second)
+	if tx := db.Create(&journal); tx.Error != nil {
+		t.Fatalf("Failed to create journal: %s", tx.Error)
+	}
+
+	target, err = sizer.Target(now)
+	if err != nil {
+		t.Fatalf("Failed to compute target: %s", err)
+	}
+	// 0.1/s * (300s + 10s) = 31, starting to refill at half that.
+	if target.HighWatermark != 31 || target.LowWatermark != 15 {
+		t.Errorf("Got watermarks %d-%d, expected 15-31", target.LowWatermark, target.HighWatermark)
+	}
+	if target.ProvisioningLatency != 10 {
+		t.Errorf("Got latency %fs, expected 10s", target.ProvisioningLatency)
+	}
+
+	sizer.Max = 20
+	target, err = sizer.Target(now)
+	if err != nil {
+		t.Fatalf("Failed to compute target: %s", err)
+	}
+	if target.HighWatermark != sizer.Max {
+		t.Errorf("Got high watermark %d, expected it capped at %d", target.HighWatermark, sizer.Max)
+	}
+}
+
+func TestPoolSizerFromEnv(t *testing.T) {
+	t.Setenv("POOL_MIN", "10")
+	t.Setenv("POOL_HORIZON", "10m")
+	sizer, err := service.PoolSizerFromEnv(nil)
+	if err != nil {
+		t.Fatalf("Failed to configure pool sizing: %s", err)
+	}
+	if sizer.Min != 10 || sizer.Max != 200 || sizer.Window != 15*time.Minute || sizer.Horizon != 10*time.Minute {
+		t.Errorf("Unexpected pool sizing %+v", sizer)
+	}
+
+	t.Setenv("POOL_MAX", "5")
+	if _, err := service.PoolSizerFromEnv(nil); err == nil {
+		t.Error("Expected a maximum below the minimum to fail")
+	}
+	t.Setenv("POOL_MAX", "")
+	t.Setenv("POOL_WINDOW", "0s")
+	if _, err := service.PoolSizerFromEnv(nil); err == nil {
+		t.Error("Expected an empty window to fail")
+	}
+}
+
+func TestDataFromEnv(t *testing.T) {
+	data, err := service.DataFromEnv(nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to configure allocation: %s", err)
+	}
+	if data.AllocationTimeout != 5*time.Second || !data.SyncFallback {
+		t.Errorf("Unexpected default allocation %+v", data)
+	}
+
+	t.Setenv("ALLOCATION_TIMEOUT", "0s")
+	t.Setenv("SYNC_FALLBACK", "false")
+	if data, err = service.DataFromEnv(nil, nil); err != nil {
+		t.Fatalf("Failed to configure allocation: %s", err)
+	}
+	if data.AllocationTimeout != 0 || data.SyncFallback {
+		t.Errorf("Unexpected allocation %+v", data)
+	}
+
+	t.Setenv("ALLOCATION_TIMEOUT", "-1s")
+	if _, err := service.DataFromEnv(nil, nil); err == nil {
+		t.Error("Expected a negative timeout to fail")
+	}
+	t.Setenv("ALLOCATION_TIMEOUT", "")
+	t.Setenv("SYNC_FALLBACK", "sometimes")
+	if _, err := service.DataFromEnv(nil, nil); err == nil {
+		t.Error("Expected an invalid fallback to fail")
+	}
+}
+
+func TestCreateUserEmptyPool(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	data := service.Data{DB: db, AllocationTimeout: 100 * time.Millisecond}
+	_, err = data.CreateUser(context.Background())
+	if !errors.Is(err, service.ErrPoolEmpty) {
+		t.Errorf("Expected %s, got %v", service.ErrPoolEmpty, err)
+	}
+
+	var exhausted *service.PoolExhaustedError
+	if !errors.As(err, &exhausted) {
+		t.Fatalf("Expected a PoolExhaustedError, got %T", err)
+	}
+	if exhausted.RetryAfter <= 0 {
+		t.Errorf("Expected a positive RetryAfter, got %s", exhausted.RetryAfter)
+	}
+}
+
+func TestCreateUserWaitsForPool(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	provider := newFakeProvider()
+
+	// Stop the pool before the database is removed, since it refills as
+	// soon as we take its wallet.
+	ctx, cancelWalletPool := context.WithCancel(context.Background())
+	poolDone := make(chan struct{})
+	defer func() {
+		cancelWalletPool()
+		<-poolDone
+	}()
+
+	// Start allocating before the pool has anything in it.
+	pool := service.NewWalletPool(db, provider, 1, 1)
+	data := service.Data{DB: db, Pool: pool, AllocationTimeout: 5 * time.Second}
+	go func() {
+		defer close(poolDone)
+		pool.Run(ctx)
+	}()
+
+	user, err := data.CreateUser(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create user: %s", err)
+	}
+	if user.Wallet.AddressBTC == "" {
+		t.Error("Got zero-valued BTC address")
+	}
+}
+
+func TestCreateUserSyncFallback(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	provider := newFakeProvider()
+
+	// The pool is never run, so it stays empty.
+	pool := service.NewWalletPool(db, provider, 1, 1)
+	data := service.Data{
+		DB:                db,
+		Pool:              pool,
+		AllocationTimeout: 10 * time.Millisecond,
+		SyncFallback:      true,
+	}
+
+	user, err := data.CreateUser(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create user: %s", err)
+	}
+
+	user_prime, err := data.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get user: %s", err)
+	}
+	if user_prime.Wallet.AddressBTC == "" || user_prime.Wallet.AddressBTC != user.Wallet.AddressBTC {
+		t.Errorf("Bitcoin addresses %s, %s do not match", user.Wallet.AddressBTC, user_prime.Wallet.AddressBTC)
+	}
+}
+
+func TestCreateUserSyncFallbackReturnsWallet(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	// Fail storing the wallet with its user, after the wallet has been
+	// provisioned, but not storing it back in the pool.
+	injected := errors.New("injected failure")
+	err = db.Callback().Create().Before("gorm:create").Register("test:fail", func(tx *gorm.DB) {
+		if wallet, ok := tx.Statement.Dest.(*service.Wallet); ok && wallet.UserID != nil {
+			_ = tx.AddError(injected)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to register callback: %s", err)
+	}
+	defer func() { _ = db.Callback().Create().Remove("test:fail") }()
+
+	pool := service.NewWalletPool(db, newFakeProvider(), 1, 1)
+	data := service.Data{DB: db, Pool: pool, AllocationTimeout: 10 * time.Millisecond, SyncFallback: true}
+
+	returned := service.WalletsReturned.Value()
+	if _, err := data.CreateUser(context.Background()); !errors.Is(err, service.ErrPoolEmpty) {
+		t.Fatalf("Expected %s, got %v", service.ErrPoolEmpty, err)
+	}
+	if n := service.WalletsReturned.Value() - returned; n != 1 {
+		t.Errorf("Counted %d returned wallets, expected 1", n)
+	}
+	if count := countPool(t, db); count != 1 {
+		t.Errorf("Pool has %d wallets, expected the wallet to be returned", count)
+	}
+	var journal service.Provisioning
+	if tx := db.Take(&journal); tx.Error != nil {
+		t.Fatalf("Failed to get journal: %s", tx.Error)
+	}
+	if journal.State != service.ProvisioningComplete {
+		t.Errorf("Journal is %s, expected it completed by returning the wallet", journal.State)
+	}
+}
+
+func TestCreateUserSyncFallbackAddressOwned(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	// Someone else's wallet already has the address the provider will give
+	// us, so the wallet can't be stored, even back in the pool.
+	owner := service.User{}
+	if tx := db.Create(&owner); tx.Error != nil {
+		t.Fatalf("Failed to create user: %s", tx.Error)
+	}
+	wallet := service.Wallet{UserID: &owner.ID, Addresses: []service.Address{
+		{AssetID: "BTC", Address: "account-0-BTC", Format: service.FormatBech32},
+	}}
+	if tx := db.Create(&wallet); tx.Error != nil {
+		t.Fatalf("Failed to create wallet: %s", tx.Error)
+	}
+
+	provider := newFakeProvider()
+	pool := service.NewWalletPool(db, provider, 1, 1)
+	pool.MaxProvisioningAttempts = 1
+	data := service.Data{DB: db, Pool: pool, AllocationTimeout: 10 * time.Millisecond, SyncFallback: true}
+
+	if _, err := data.CreateUser(context.Background()); !errors.Is(err, service.ErrPoolEmpty) {
+		t.Fatalf("Expected %s, got %v", service.ErrPoolEmpty, err)
+	}
+
+	// It's given up on rather than left to be resumed forever.
+	var journal service.Provisioning
+	if tx := db.Take(&journal); tx.Error != nil {
+		t.Fatalf("Failed to get journal: %s", tx.Error)
+	}
+	if journal.State != service.ProvisioningAbandoned || !strings.Contains(journal.LastError, service.ErrAddressOwned.Error()) {
+		t.Errorf("Journal is %s with error %q, expected it abandoned as the address is owned", journal.State, journal.LastError)
+	}
+	if !provider.retired[journal.VaultAccountID] {
+		t.Errorf("Account %s wasn't retired", journal.VaultAccountID)
+	}
+}
+
+func TestCreateUserHandlerPoolExhausted(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	// The provider is down, so the pool stays empty and the breaker is
+	// open.
+	provider := newFakeProvider()
+	pool := service.NewWalletPool(db, provider, 1, 1)
+	pool.Retry.Breaker = fireblocks.NewCircuitBreaker(1, 30*time.Second)
+	pool.Retry.Breaker.Failure()
+	data := service.Data{
+		DB:                db,
+		Pool:              pool,
+		AllocationTimeout: 10 * time.Millisecond,
+		SyncFallback:      true,
+	}
+
+	recorder := httptest.NewRecorder()
+	data.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/user", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Got status %d, expected %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "30" {
+		t.Errorf("Got Retry-After %q, expected the breaker's cooldown", retryAfter)
+	}
+	if len(provider.accounts) != 0 {
+		t.Errorf("Provisioned %d accounts inline with the breaker open", len(provider.accounts))
+	}
+}
+
+func TestCreateUserReturnsWalletOnFailure(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	wallet := service.Wallet{AddressBTC: "tb1qreturned"}
+	if tx := db.Create(&wallet); tx.Error != nil {
+		t.Fatalf("Failed to create wallet: %s", tx.Error)
+	}
+
+	// Fail loading the wallet's addresses, after it's been claimed.
+	injected := errors.New("injected failure")
+	err = db.Callback().Query().Before("gorm:query").Register("test:fail", func(tx *gorm.DB) {
+		if tx.Statement.Table == "addresses" {
+			_ = tx.AddError(injected)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to register callback: %s", err)
+	}
+
+	returned := service.WalletsReturned.Value()
+	data := service.Data{DB: db}
+	if _, err := data.CreateUser(context.Background()); !errors.Is(err, injected) {
+		t.Fatalf("Expected %s, got %v", injected, err)
+	}
+
+	if err := db.Callback().Query().Remove("test:fail"); err != nil {
+		t.Fatalf("Failed to remove callback: %s", err)
+	}
+
+	if count := countPool(t, db); count != 1 {
+		t.Errorf("Pool has %d wallets, expected the wallet to be returned", count)
+	}
+	if n := service.WalletsReturned.Value() - returned; n != 1 {
+		t.Errorf("Counted %d returned wallets, expected 1", n)
+	}
+
+	var users int64
+	if tx := db.Model(&service.User{}).Count(&users); tx.Error != nil {
+		t.Fatalf("Failed to count users: %s", tx.Error)
+	}
+	if users != 0 {
+		t.Errorf("Found %d users, expected the user to be rolled back", users)
+	}
+}
+
+// On PostgreSQL, users' IDs come from the database. This only runs with
+// TEST_DATABASE=postgres, against the tests' own server.
+func TestPostgresGeneratesUserIDs(t *testing.T) {
+	if testDatabase != "postgres" {
+		t.Skip("Needs PostgreSQL, with TEST_DATABASE=postgres")
+	}
+	db, err := setupDatabase()
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	var inserts []string
+	err = db.Callback().Create().After("gorm:create").Register("test:record", func(tx *gorm.DB) {
+		if tx.Statement.Table == "users" {
+			inserts = append(inserts, tx.Statement.SQL.String())
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to register callback: %s", err)
+	}
+	defer func() { _ = db.Callback().Create().Remove("test:record") }()
+
+	if tx := db.Create(&service.Wallet{AddressBTC: "tb1qpostgres"}); tx.Error != nil {
+		t.Fatalf("Failed to create wallet: %s", tx.Error)
+	}
+
+	data := service.Data{DB: db}
+	user, err := data.CreateUser(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create user: %s", err)
+	}
+	if user.ID == uuid.Nil {
+		t.Error("User has no ID")
+	}
+	if user.Wallet.UserID == nil || *user.Wallet.UserID != user.ID {
+		t.Errorf("Wallet %d not assigned to user %s", user.Wallet.ID, user.ID)
+	}
+
+	if len(inserts) != 1 {
+		t.Fatalf("Inserted %d users, expected 1", len(inserts))
+	}
+	columns, _, _ := strings.Cut(inserts[0], "VALUES")
+	if strings.Contains(columns, `"id"`) || !strings.Contains(inserts[0], `RETURNING "id"`) {
+		t.Errorf("Expected the database to generate the user's ID, inserted it with %s", inserts[0])
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	wg, stopMock := setupMock(fbBaseHost)
+	defer wg.Wait()
+	defer stopMock()
+
+	provider := newProvider(t)
+
+	threshold := 1
+
+	ctx, cancelWalletPool := context.WithCancel(context.Background())
+	defer cancelWalletPool()
+	pool := service.NewWalletPool(db, provider, threshold, threshold)
+	go pool.Run(ctx)
+	waitFull(t, pool)
+
+	data := service.Data{DB: db, Pool: pool}
+
+	user, err := data.CreateUser(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create user: %s", err)
+	}
+
+	user_prime, err := data.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get user: %s", err)
+	}
+
+	if user.ID != user_prime.ID {
+		t.Errorf("User IDs %s, %s do not match", user.ID, user_prime.ID)
+	}
+
+	if user.Wallet.ID != user_prime.Wallet.ID {
+		t.Errorf("Wallet IDs %d, %d do not match", user.Wallet.ID, user_prime.Wallet.ID)
+	}
+
+	if user.Wallet.AddressBTC != user_prime.Wallet.AddressBTC {
+		t.Errorf("Bitcoin addresses %s, %s do not match", user.Wallet.AddressBTC, user_prime.Wallet.AddressBTC)
+	}
+
+	if user.Wallet.AddressSOL != user_prime.Wallet.AddressSOL {
+		t.Errorf("Solana addresses %s, %s do not match", user.Wallet.AddressSOL, user_prime.Wallet.AddressSOL)
+	}
+
+	if user_prime.Wallet.UserID == nil || *user_prime.Wallet.UserID != user.ID {
+		t.Errorf("Wallet %d not assigned to user %s", user_prime.Wallet.ID, user.ID)
+	}
+
+	// Allocation should wake the pool up to replace the wallet.
+	waitFull(t, pool)
+}
+
+func TestCreateUserConcurrent(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	n := 10
+	for i := range n {
+		wallet := service.Wallet{AddressBTC: fmt.Sprintf("tb1q%d", i)}
+		if tx := db.Create(&wallet); tx.Error != nil {
+			t.Fatalf("Failed to create wallet: %s", tx.Error)
+		}
+	}
+
+	// Two Data instances stand in for two replicas sharing a database.
+	replicas := []service.Data{{DB: db}, {DB: db}}
+
+	var mu sync.Mutex
+	seen := make(map[uint]bool)
+	var wg sync.WaitGroup
+	for i := range n + 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := replicas[i%len(replicas)].CreateUser(context.Background())
+			if errors.Is(err, service.ErrPoolEmpty) {
+				return
+			}
+			if err != nil {
+				t.Errorf("Failed to create user: %s", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if seen[user.Wallet.ID] {
+				t.Errorf("Wallet %d assigned twice", user.Wallet.ID)
+			}
+			seen[user.Wallet.ID] = true
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != n {
+		t.Errorf("Assigned %d wallets, expected %d", len(seen), n)
+	}
+}
+
+func TestLease(t *testing.T) {
+	db, err := setupDatabase()
+	defer os.Remove(databaseFile)
+	if err != nil {
+		t.Fatalf("Error instantiating the database: %s", err)
+	}
+
+	a := service.Lease{DB: db, Name: "test", Holder: "a", Slots: 1, TTL: time.Minute}
+	b := service.Lease{DB: db, Name: "test", Holder: "b", Slots: 1, TTL: time.Minute}
+
+	if held, err := a.Acquire(); err != nil || !held {
+		t.Fatalf("Expected a to acquire the lease, got %t, %v", held, err)
+	}
+	if held, err := a.Acquire(); err != nil || !held {
+		t.Fatalf("Expected a to renew the lease, got %t, %v", held, err)
+	}
+	if held, err := b.Acquire(); err != nil || held {
+		t.Fatalf("Expected b not to acquire the lease, got %t, %v", held, err)
+	}
+
+	if err := a.Release(); err != nil {
+		t.Fatalf("Failed to release lease: %s", err)
+	}
+	if held, err := b.Acquire(); err != nil || !held {
+		t.Fatalf("Expected b to acquire the released lease, got %t, %v", held, err)
+	}
+
+	// An expired lease can be taken over.
+	c := service.Lease{DB: db, Name: "expiring", Holder: "c", Slots: 1, TTL: -time.Second}
+	d := service.Lease{DB: db, Name: "expiring", Holder: "d", Slots: 1, TTL: time.Minute}
+	if held, err := c.Acquire(); err != nil || !held {
+		t.Fatalf("Expected c to acquire the lease, got %t, %v", held, err)
+	}
+	if held, err := d.Acquire(); err != nil || !held {
+		t.Fatalf("Expected d to take over the expired lease, got %t, %v", held, err)
 	}
 }
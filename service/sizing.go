@@ -0,0 +1,141 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PoolSizer computes pool watermarks from recent demand, so the pool holds
+// enough wallets to cover the next Horizon of sign-ups (plus however long it
+// takes to provision a wallet) without hoarding them when it's quiet.
+//
+// Both demand and latency are measured from the database rather than in
+// memory, so they account for every replica and survive restarts.
+type PoolSizer struct {
+	DB *gorm.DB
+	// Bounds on the high watermark.
+	Min int
+	Max int
+	// How far back to look when measuring demand and latency.
+	Window time.Duration
+	// How much future demand the pool should cover.
+	Horizon time.Duration
+}
+
+// Configure a sizer from POOL_MIN (default 5), POOL_MAX (default 200),
+// POOL_WINDOW (default 15m) and POOL_HORIZON (default 5m).
+func PoolSizerFromEnv(db *gorm.DB) (*PoolSizer, error) {
+	sizer := PoolSizer{
+		DB:      db,
+		Min:     5,
+		Max:     200,
+		Window:  15 * time.Minute,
+		Horizon: 5 * time.Minute,
+	}
+
+	for name, value := range map[string]*int{
+		"POOL_MIN": &sizer.Min,
+		"POOL_MAX": &sizer.Max,
+	} {
+		if s := os.Getenv(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*value = n
+		}
+	}
+	for name, value := range map[string]*time.Duration{
+		"POOL_WINDOW":  &sizer.Window,
+		"POOL_HORIZON": &sizer.Horizon,
+	} {
+		if s := os.Getenv(name); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*value = d
+		}
+	}
+
+	if sizer.Min < 1 {
+		return nil, fmt.Errorf("invalid POOL_MIN: %d is less than 1", sizer.Min)
+	}
+	if sizer.Min > sizer.Max {
+		return nil, fmt.Errorf("invalid POOL_MAX: %d is less than POOL_MIN %d", sizer.Max, sizer.Min)
+	}
+	if sizer.Window <= 0 {
+		return nil, fmt.Errorf("invalid POOL_WINDOW: %s isn't positive", sizer.Window)
+	}
+	if sizer.Horizon < 0 {
+		return nil, fmt.Errorf("invalid POOL_HORIZON: %s is negative", sizer.Horizon)
+	}
+	return &sizer, nil
+}
+
+// A pool size and the measurements it was computed from.
+type PoolTarget struct {
+	LowWatermark  int `json:"low_watermark"`
+	HighWatermark int `json:"high_watermark"`
+	// Users created per second, averaged over the window.
+	AllocationRate float64 `json:"allocation_rate"`
+	// Mean time to provision a wallet over the window, in seconds.
+	ProvisioningLatency float64   `json:"provisioning_latency"`
+	ComputedAt          time.Time `json:"computed_at"`
+}
+
+// Mean time from starting to completing provisioning for wallets completed
+// since the given time.
+func (s *PoolSizer) provisioningLatency(since time.Time) (time.Duration, error) {
+	var journals []Provisioning
+	err := s.DB.Select("created_at", "updated_at").
+		Where("state = ? AND updated_at >= ?", ProvisioningComplete, since).
+		Find(&journals).Error
+	if err != nil || len(journals) == 0 {
+		return 0, err
+	}
+
+	var total time.Duration
+	for _, journal := range journals {
+		total += journal.UpdatedAt.Sub(journal.CreatedAt)
+	}
+	return total / time.Duration(len(journals)), nil
+}
+
+// Compute the target pool size as of now.
+func (s *PoolSizer) Target(now time.Time) (*PoolTarget, error) {
+	since := now.Add(-s.Window)
+
+	var allocations int64
+	if err := s.DB.Model(&User{}).Where("created_at >= ?", since).Count(&allocations).Error; err != nil {
+		return nil, err
+	}
+	rate := float64(allocations) / s.Window.Seconds()
+
+	latency, err := s.provisioningLatency(since)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cover the horizon, plus what's allocated while we refill.
+	high := int(math.Ceil(rate * (s.Horizon + latency).Seconds()))
+	high = max(s.Min, min(s.Max, high))
+
+	// Start refilling while there's still enough left to cover demand for as
+	// long as a refill takes, and no later than half empty.
+	low := int(math.Ceil(rate*latency.Seconds())) + 1
+	low = max(1, min(high, max(low, high/2)))
+
+	return &PoolTarget{
+		LowWatermark:        low,
+		HighWatermark:       high,
+		AllocationRate:      rate,
+		ProvisioningLatency: latency.Seconds(),
+		ComputedAt:          now,
+	}, nil
+}